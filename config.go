@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+const repoConfigFilename = ".voodoobox.yaml"
+
+// allowLoadRestrictionsNone allows repo config to disable kustomize load restrictor, since
+// with `LoadRestrictionsNone` kustomization can read any file of the repo server (i.e. other
+// app's decrypted secrets or service account token) it must be enabled by admin
+var allowLoadRestrictionsNone bool
+
+// repoConfig is the optional per repository config read from `.voodoobox.yaml`
+// file located in the app directory
+type repoConfig struct {
+	// BuildRoot is the path of kustomize build root relative to app directory
+	BuildRoot string `json:"buildRoot,omitempty"`
+	// Kustomize holds extra kustomize build flags
+	Kustomize kustomizeConfig `json:"kustomize,omitempty"`
+	// DecryptPaths are glob patterns of files or directories relative to app
+	// directory, if set only matching files will be decrypted
+	DecryptPaths []string `json:"decryptPaths,omitempty"`
+	// GitSSH holds mapping of remote base repositories to ssh keys
+	GitSSH gitSSHConfig `json:"gitSSH,omitempty"`
+	Policy policyConfig `json:"policy,omitempty"`
+}
+
+type kustomizeConfig struct {
+	// LoadRestrictor is same as `kustomize build --load-restrictor`
+	LoadRestrictor string `json:"loadRestrictor,omitempty"`
+	// EnableHelm is same as `kustomize build --enable-helm`
+	EnableHelm bool `json:"enableHelm,omitempty"`
+}
+
+type gitSSHConfig struct {
+	Keys []repoKey `json:"keys,omitempty"`
+}
+
+// repoKey maps remote base repository URL prefix to the name of ssh key in git ssh secret
+// i.e. `github.com/org/repo1` will match `ssh://git@github.com/org/repo1//manifests?ref=main`
+type repoKey struct {
+	Repo string `json:"repo"`
+	Key  string `json:"key"`
+}
+
+type policyConfig struct {
+	// RequireKeyring will fail the render if strongbox keyring secret is not found
+	RequireKeyring bool `json:"requireKeyring,omitempty"`
+}
+
+// repoConfigError is returned when `.voodoobox.yaml` is malformed
+type repoConfigError struct {
+	field string
+	err   error
+}
+
+func (e *repoConfigError) Error() string {
+	if e.field == "" {
+		return fmt.Sprintf("invalid %s: err=%s", repoConfigFilename, e.err)
+	}
+	return fmt.Sprintf("invalid %s: field=%s err=%s", repoConfigFilename, e.field, e.err)
+}
+
+// loadRepoConfig reads and validates `.voodoobox.yaml` from given app dir,
+// empty config is returned if file doesn't exist
+func loadRepoConfig(cwd string) (repoConfig, error) {
+	var cfg repoConfig
+
+	data, err := os.ReadFile(filepath.Join(cwd, repoConfigFilename))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return cfg, &repoConfigError{err: err}
+	}
+	if bytes.Equal(bytes.TrimSpace(jsonData), []byte("null")) {
+		return cfg, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, &repoConfigError{err: err}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func (c repoConfig) validate() error {
+	if c.BuildRoot != "" && !isLocalPath(c.BuildRoot) {
+		return &repoConfigError{field: "buildRoot", err: errors.New("must be a relative path within app directory")}
+	}
+
+	switch c.Kustomize.LoadRestrictor {
+	case "", types.LoadRestrictionsRootOnly.String():
+	case types.LoadRestrictionsNone.String():
+		if !allowLoadRestrictionsNone {
+			return &repoConfigError{field: "kustomize.loadRestrictor", err: fmt.Errorf("%s is not allowed by server config",
+				types.LoadRestrictionsNone)}
+		}
+	default:
+		return &repoConfigError{field: "kustomize.loadRestrictor", err: fmt.Errorf("must be one of %s or %s",
+			types.LoadRestrictionsRootOnly, types.LoadRestrictionsNone)}
+	}
+
+	for i, p := range c.DecryptPaths {
+		field := fmt.Sprintf("decryptPaths[%d]", i)
+		if !isLocalPath(p) {
+			return &repoConfigError{field: field, err: errors.New("must be a relative path within app directory")}
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return &repoConfigError{field: field, err: err}
+		}
+	}
+
+	for i, k := range c.GitSSH.Keys {
+		if k.Repo == "" {
+			return &repoConfigError{field: fmt.Sprintf("gitSSH.keys[%d].repo", i), err: errors.New("required")}
+		}
+		if k.Key == "" {
+			return &repoConfigError{field: fmt.Sprintf("gitSSH.keys[%d].key", i), err: errors.New("required")}
+		}
+	}
+
+	return nil
+}
+
+// buildRootPath returns absolute path of kustomize build root
+func (c repoConfig) buildRootPath(cwd string) string {
+	if c.BuildRoot == "" {
+		return cwd
+	}
+	return filepath.Join(cwd, c.BuildRoot)
+}
+
+// shouldDecrypt returns true if file with given path relative to
+// app dir matches any of the decrypt paths or if decrypt paths are not set
+func (c repoConfig) shouldDecrypt(rel string) bool {
+	if len(c.DecryptPaths) == 0 {
+		return true
+	}
+	for _, p := range c.DecryptPaths {
+		p = filepath.Clean(p)
+		if ok, _ := filepath.Match(p, rel); ok {
+			return true
+		}
+		if p == "." || strings.HasPrefix(rel, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLocalPath(p string) bool {
+	return !filepath.IsAbs(p) && filepath.IsLocal(filepath.Clean(p))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"sigs.k8s.io/kustomize/api/types"
+)
+
+func Test_loadRepoConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		want      repoConfig
+		wantField string
+		wantErr   bool
+	}{
+		{
+			"empty",
+			"",
+			repoConfig{},
+			"", false,
+		},
+		{
+			"valid",
+			`buildRoot: overlays/prod
+kustomize:
+  loadRestrictor: LoadRestrictionsRootOnly
+  enableHelm: true
+decryptPaths:
+  - secrets/
+  - "*.env"
+gitSSH:
+  keys:
+    - repo: github.com/org/repo1
+      key: keyA
+policy:
+  requireKeyring: true
+`,
+			repoConfig{
+				BuildRoot:    "overlays/prod",
+				Kustomize:    kustomizeConfig{LoadRestrictor: "LoadRestrictionsRootOnly", EnableHelm: true},
+				DecryptPaths: []string{"secrets/", "*.env"},
+				GitSSH:       gitSSHConfig{Keys: []repoKey{{Repo: "github.com/org/repo1", Key: "keyA"}}},
+				Policy:       policyConfig{RequireKeyring: true},
+			},
+			"", false,
+		},
+		{"malformed-yaml", "buildRoot: [", repoConfig{}, "", true},
+		{"unknown-field", "buildPath: app", repoConfig{}, "", true},
+		{"wrong-type", "decryptPaths: secrets", repoConfig{}, "", true},
+		{"build-root-outside-app", "buildRoot: ../other-app", repoConfig{}, "buildRoot", true},
+		{"build-root-absolute", "buildRoot: /etc", repoConfig{}, "buildRoot", true},
+		{"invalid-load-restrictor", "kustomize:\n  loadRestrictor: none", repoConfig{}, "kustomize.loadRestrictor", true},
+		// LoadRestrictionsNone is only allowed by server flag
+		{"load-restrictor-none-not-allowed", "kustomize:\n  loadRestrictor: LoadRestrictionsNone", repoConfig{}, "kustomize.loadRestrictor", true},
+		{"invalid-decrypt-path", "decryptPaths:\n  - secrets/[", repoConfig{}, "decryptPaths[0]", true},
+		{"missing-key", "gitSSH:\n  keys:\n    - repo: github.com/org/repo1", repoConfig{}, "gitSSH.keys[0].key", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.config != "" {
+				if err := os.WriteFile(filepath.Join(dir, repoConfigFilename), []byte(tt.config), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := loadRepoConfig(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadRepoConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				var cfgErr *repoConfigError
+				if !errors.As(err, &cfgErr) {
+					t.Fatalf("loadRepoConfig() error should be repoConfigError got:%v", err)
+				}
+				if cfgErr.field != tt.wantField {
+					t.Errorf("loadRepoConfig() error field=%s want=%s", cfgErr.field, tt.wantField)
+				}
+				return
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(repoConfig{})); diff != "" {
+				t.Errorf("loadRepoConfig() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_loadRepoConfig_loadRestrictorNone(t *testing.T) {
+	defer func(prev bool) { allowLoadRestrictionsNone = prev }(allowLoadRestrictionsNone)
+	allowLoadRestrictionsNone = true
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, repoConfigFilename), []byte("kustomize:\n  loadRestrictor: LoadRestrictionsNone"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadRepoConfig(dir)
+	if err != nil {
+		t.Fatalf("loadRepoConfig() unexpected error = %v", err)
+	}
+	if opts := kustomizeOptions("", got.Kustomize); opts.LoadRestrictions != types.LoadRestrictionsNone {
+		t.Errorf("load restrictor should be disabled got:%s", opts.LoadRestrictions)
+	}
+
+	allowLoadRestrictionsNone = false
+	if opts := kustomizeOptions("", got.Kustomize); opts.LoadRestrictions != types.LoadRestrictionsRootOnly {
+		t.Errorf("load restrictor should not be disabled if not allowed got:%s", opts.LoadRestrictions)
+	}
+}
+
+func Test_shouldDecrypt(t *testing.T) {
+	cfg := repoConfig{DecryptPaths: []string{"app/secrets/", "*.env", "secrets/s?.yaml"}}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"app/secrets/s1.json", true},
+		{"app/secrets/nested/s1.json", true},
+		{"app/secrets-other/s1.json", false},
+		{"prod.env", true},
+		{"app/prod.env", false},
+		{"secrets/s1.yaml", true},
+		{"secrets/strongbox-keyring", false},
+	}
+	for _, tt := range tests {
+		if got := cfg.shouldDecrypt(tt.path); got != tt.want {
+			t.Errorf("shouldDecrypt(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	if !(repoConfig{}).shouldDecrypt("any/file") {
+		t.Error("all files should be decrypted without decrypt paths")
+	}
+}
+
+func Test_repoConfigBuild(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	if out, err := exec.Command("cp", "-r", "./testData/app-with-secrets", dir).CombinedOutput(); err != nil {
+		t.Fatalf("%s", out)
+	}
+	config := "buildRoot: app\ndecryptPaths:\n  - app/\n"
+	if err := os.WriteFile(filepath.Join(dir, repoConfigFilename), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadRepoConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := strongboxRecursiveDecrypt(context.Background(), dir, getFileContent(t, dir+"/.keyRing"), cfg.shouldDecrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// secrets/strongbox-keyring is outside of decrypt paths
+	if len(report) != 4 {
+		t.Errorf("expected 4 decrypted files got:%v", report)
+	}
+
+	got, err := ensureBuild(context.Background(), dir, "", "", applicationInfo{name: "foo", destinationNamespace: "foo", config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "name: app-bar-files") {
+		t.Errorf("build root resources missing from output\n%s", got)
+	}
+	if strings.Contains(string(got), "name: strongbox-keyring") {
+		t.Errorf("resources outside of build root should not be built\n%s", got)
+	}
+}
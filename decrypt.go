@@ -2,23 +2,28 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"filippo.io/age"
 	"filippo.io/age/armor"
+	"github.com/ghodss/yaml"
+	"github.com/jacobsa/crypto/siv"
 )
 
 const (
 	strongboxIdentityFilename = ".strongbox_identity"
 	strongboxKeyringFilename  = ".strongbox_keyring"
+	strongboxKeyIDFilename    = ".strongbox-keyid"
 )
 
 var (
@@ -26,45 +31,68 @@ var (
 	errEncryptedFileFound = errors.New("encrypted file found")
 )
 
-func ensureDecryption(ctx context.Context, cwd string, app applicationInfo) error {
-	keyringData, identityData, err := secretData(ctx, app.destinationNamespace, app.keyringSecret)
+const (
+	formatLegacy = "legacy"
+	formatAge    = "age"
+)
+
+// decryptedFile holds details of a file decrypted by ensureDecryption
+type decryptedFile struct {
+	// path relative to the working dir
+	path   string
+	format string
+	// key is the key-id for legacy format and recipient for age format
+	key string
+}
+
+func ensureDecryption(ctx context.Context, cwd string, app applicationInfo) ([]decryptedFile, error) {
+	keyringData, identityData, err := keyringSecretsData(ctx, app)
 	if err != nil {
-		if errors.Is(err, errNotFound) {
-			return nil
+		if errors.Is(err, errNotFound) && !app.config.Policy.RequireKeyring {
+			return nil, nil
 		}
-		return err
+		return nil, err
 	}
 	if keyringData == nil && identityData == nil {
-		return nil
+		if app.config.Policy.RequireKeyring {
+			return nil, fmt.Errorf("keyring secret doesn't contain keyring or identity but it is required by %s: secret=%s", repoConfigFilename, app.keyringSecrets[0].name)
+		}
+		return nil, nil
 	}
 
+	var report []decryptedFile
+
 	// create Strongbox keyRing file
 	if keyringData != nil {
 		keyRingPath := filepath.Join(cwd, strongboxKeyringFilename)
 		if err := os.WriteFile(keyRingPath, keyringData, 0644); err != nil {
-			return err
+			return nil, err
 		}
 
-		if err := runStrongboxDecryption(ctx, cwd, keyRingPath); err != nil {
-			return fmt.Errorf("unable to decrypt err:%s", err)
+		files, err := strongboxRecursiveDecrypt(ctx, cwd, keyringData, app.config.shouldDecrypt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt err:%s", err)
 		}
+		report = append(report, files...)
 	}
 
 	if identityData != nil {
 		identityPath := filepath.Join(cwd, strongboxIdentityFilename)
 		if err := os.WriteFile(identityPath, identityData, 0644); err != nil {
-			return err
+			return nil, err
 		}
-		if err := strongboxAgeRecursiveDecrypt(ctx, cwd, identityData); err != nil {
-			return fmt.Errorf("unable to decrypt err:%s", err)
+		files, err := strongboxAgeRecursiveDecrypt(ctx, cwd, identityData, app.config.shouldDecrypt)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt err:%s", err)
 		}
+		report = append(report, files...)
 	}
 
-	return nil
+	return report, nil
 }
 
-func secretData(ctx context.Context, destinationNamespace string, si secretInfo) ([]byte, []byte, error) {
-	secret, err := secret(ctx, destinationNamespace, si)
+func secretData(ctx context.Context, app applicationInfo, si secretInfo) ([]byte, []byte, error) {
+	secret, err := secret(ctx, app, si)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -72,25 +100,259 @@ func secretData(ctx context.Context, destinationNamespace string, si secretInfo)
 	return secret.Data[strongboxKeyringFilename], secret.Data[strongboxIdentityFilename], nil
 }
 
-// runStrongboxDecryption will try to decrypt files in cwd using given keyRing file
-func runStrongboxDecryption(ctx context.Context, cwd, keyringPath string) error {
-	s := exec.CommandContext(ctx, "strongbox", "-keyring", keyringPath, "-decrypt", "-recursive", cwd)
+// strongboxKeyRing is the legacy (SIV) strongbox keyring file format
+type strongboxKeyRing struct {
+	KeyEntries []strongboxKeyEntry `json:"keyentries"`
+}
+
+type strongboxKeyEntry struct {
+	Description string `json:"description"`
+	KeyID       string `json:"key-id"`
+	Key         string `json:"key"`
+}
+
+// parseKeyRing parses legacy strongbox keyring data and returns map of
+// key-id and decoded key
+func parseKeyRing(keyringData []byte) (map[string][]byte, error) {
+	var kr strongboxKeyRing
+	if err := yaml.Unmarshal(keyringData, &kr); err != nil {
+		return nil, fmt.Errorf("unable to parse keyring err:%s", err)
+	}
+
+	keys := make(map[string][]byte)
+	for _, ke := range kr.KeyEntries {
+		key, err := base64.StdEncoding.DecodeString(ke.Key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode key: key-id=%s err:%s", ke.KeyID, err)
+		}
+		keys[ke.KeyID] = key
+	}
+	return keys, nil
+}
+
+// strongboxRecursiveDecrypt will decrypt all strongbox (SIV) encrypted files in cwd
+// using keys from given keyring data. key used for a file is the one referenced by
+// the closest `.strongbox-keyid` file, if there is none or its key is missing from
+// the keyring all keys are tried same as strongbox.
+// only files for which shouldDecrypt returns true for path relative to cwd are decrypted.
+func strongboxRecursiveDecrypt(ctx context.Context, cwd string, keyringData []byte, shouldDecrypt func(string) bool) ([]decryptedFile, error) {
+	keys, err := parseKeyRing(keyringData)
+	if err != nil {
+		return nil, err
+	}
+
+	var report []decryptedFile
+	err = filepath.WalkDir(cwd, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			// skip .git directory
+			if d.Name() == ".git" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if !shouldDecrypt(relPath(cwd, path)) {
+			return nil
+		}
+
+		in, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(in, encryptedFilePrefix) {
+			return nil
+		}
+
+		keyID, err := findKeyID(cwd, path)
+		if err != nil {
+			return err
+		}
 
-	stderr, err := s.CombinedOutput()
+		var out []byte
+		if key, ok := keys[keyID]; ok {
+			if out, err = strongboxDecrypt(in, key); err != nil {
+				return fmt.Errorf("unable to decrypt file: path=%s key-id=%s err:%s", path, keyID, err)
+			}
+		} else if keyID != "" {
+			logger.Warn("key not found in keyring, trying all keys", "path", relPath(cwd, path), "key-id", keyID)
+			var usedKeyID string
+			if out, usedKeyID, err = strongboxDecryptWithAnyKey(in, keys); err != nil {
+				return fmt.Errorf("unable to decrypt file, key not found in keyring: path=%s key-id=%s err:%s", path, keyID, err)
+			}
+			keyID = usedKeyID
+		} else {
+			if out, keyID, err = strongboxDecryptWithAnyKey(in, keys); err != nil {
+				return fmt.Errorf("unable to decrypt file: path=%s err:%s", path, err)
+			}
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, out, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		report = append(report, decryptedFile{path: relPath(cwd, path), format: formatLegacy, key: keyID})
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("error running strongbox err:%s ", stderr)
+		return nil, err
 	}
 
-	return nil
+	return report, nil
 }
 
-func strongboxAgeRecursiveDecrypt(ctx context.Context, cwd string, identityData []byte) error {
-	identities, err := age.ParseIdentities(bytes.NewBuffer(identityData))
+// relPath returns path relative to given base dir, if that is not possible
+// path is returned as is
+func relPath(base, path string) string {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// findKeyID returns key-id from the closest `.strongbox-keyid` file, looking
+// from the directory of the given file up to the root dir
+func findKeyID(root, path string) (string, error) {
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		data, err := os.ReadFile(filepath.Join(dir, strongboxKeyIDFilename))
+		if err == nil {
+			return strings.TrimSpace(string(data)), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return "", nil
+		}
+	}
+}
+
+// strongboxDecryptWithAnyKey tries all given keys and returns decrypted data
+// along with the key-id of the key that worked
+func strongboxDecryptWithAnyKey(in []byte, keys map[string][]byte) ([]byte, string, error) {
+	keyIDs := make([]string, 0, len(keys))
+	for keyID := range keys {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+
+	for _, keyID := range keyIDs {
+		if out, err := strongboxDecrypt(in, keys[keyID]); err == nil {
+			return out, keyID, nil
+		}
+	}
+	return nil, "", fmt.Errorf("none of the keys could decrypt data: key-ids=%s", strings.Join(keyIDs, ","))
+}
+
+// strongboxDecrypt decrypts strongbox (SIV) encrypted data. first line is the
+// header followed by base64 encoded and gzip compressed ciphertext
+func strongboxDecrypt(in []byte, key []byte) ([]byte, error) {
+	spl := bytes.SplitN(in, []byte("\n"), 2)
+	if len(spl) != 2 {
+		return nil, errors.New("unable to split header from encrypted data")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(spl[1]), nil)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode encrypted data err:%s", err)
+	}
+
+	compressed, err := siv.Decrypt(key, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress decrypted data err:%s", err)
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// smudge is used as git smudge filter for remote bases cloned by kustomize. it will
+// decrypt data using keyring and identity files located in given home dir. if data
+// can't be decrypted, it is passed through as is and will be caught by ciphertext checks
+func smudge(in io.Reader, out io.Writer, home string) error {
+	data, err := io.ReadAll(in)
 	if err != nil {
 		return err
 	}
 
-	return filepath.Walk(cwd, func(path string, info os.FileInfo, err error) error {
+	switch {
+	case bytes.HasPrefix(data, encryptedFilePrefix):
+		keyringData, err := os.ReadFile(filepath.Join(home, strongboxKeyringFilename))
+		if err != nil {
+			logger.Warn("unable to read keyring for smudge filter", "err", err)
+			break
+		}
+		keys, err := parseKeyRing(keyringData)
+		if err != nil {
+			logger.Warn("unable to parse keyring for smudge filter", "err", err)
+			break
+		}
+		dec, _, err := strongboxDecryptWithAnyKey(data, keys)
+		if err != nil {
+			logger.Warn("unable to decrypt data in smudge filter", "err", err)
+			break
+		}
+		data = dec
+
+	case bytes.HasPrefix(data, []byte(armor.Header)):
+		identityData, err := os.ReadFile(filepath.Join(home, strongboxIdentityFilename))
+		if err != nil {
+			logger.Warn("unable to read identity for smudge filter", "err", err)
+			break
+		}
+		identities, err := age.ParseIdentities(bytes.NewBuffer(identityData))
+		if err != nil {
+			logger.Warn("unable to parse identity for smudge filter", "err", err)
+			break
+		}
+		ar, err := age.Decrypt(armor.NewReader(bytes.NewReader(data)), identities...)
+		if err != nil {
+			logger.Warn("unable to decrypt data in smudge filter", "err", err)
+			break
+		}
+		dec, err := io.ReadAll(ar)
+		if err != nil {
+			logger.Warn("unable to decrypt data in smudge filter", "err", err)
+			break
+		}
+		data = dec
+	}
+
+	_, err = out.Write(data)
+	return err
+}
+
+func strongboxAgeRecursiveDecrypt(ctx context.Context, cwd string, identityData []byte, shouldDecrypt func(string) bool) ([]decryptedFile, error) {
+	identities, err := age.ParseIdentities(bytes.NewBuffer(identityData))
+	if err != nil {
+		return nil, err
+	}
+
+	// wrap identities to find out which one was used to decrypt each file
+	var usedRecipient string
+	for i, id := range identities {
+		identities[i] = reportingIdentity{Identity: id, used: &usedRecipient}
+	}
+
+	var report []decryptedFile
+	err = filepath.Walk(cwd, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -103,6 +365,10 @@ func strongboxAgeRecursiveDecrypt(ctx context.Context, cwd string, identityData
 			return nil
 		}
 
+		if !shouldDecrypt(relPath(cwd, path)) {
+			return nil
+		}
+
 		file, err := os.OpenFile(path, os.O_RDWR, 0644)
 		if err != nil {
 			return err
@@ -117,10 +383,11 @@ func strongboxAgeRecursiveDecrypt(ctx context.Context, cwd string, identityData
 			return nil
 		}
 
+		usedRecipient = ""
 		armorReader := armor.NewReader(bytes.NewReader(in))
 		ar, err := age.Decrypt(armorReader, identities...)
 		if err != nil {
-			return err
+			return fmt.Errorf("unable to decrypt file: path=%s err:%w", path, err)
 		}
 		if _, err := file.Seek(0, io.SeekStart); err != nil {
 			return err
@@ -129,6 +396,40 @@ func strongboxAgeRecursiveDecrypt(ctx context.Context, cwd string, identityData
 		if err != nil {
 			return err
 		}
-		return file.Truncate(n)
+		if err := file.Truncate(n); err != nil {
+			return err
+		}
+
+		report = append(report, decryptedFile{path: relPath(cwd, path), format: formatAge, key: usedRecipient})
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// reportingIdentity wraps age identity and records its recipient
+// when it is successfully used to unwrap file key
+type reportingIdentity struct {
+	age.Identity
+	used *string
+}
+
+func (i reportingIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	fileKey, err := i.Identity.Unwrap(stanzas)
+	if err != nil {
+		return nil, err
+	}
+
+	switch id := i.Identity.(type) {
+	case *age.X25519Identity:
+		*i.used = id.Recipient().String()
+	case *age.HybridIdentity:
+		*i.used = id.Recipient().String()
+	default:
+		*i.used = fmt.Sprintf("%T", id)
+	}
+	return fileKey, nil
 }
@@ -6,9 +6,14 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/google/go-cmp/cmp"
 	v1 "k8s.io/api/core/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
@@ -117,7 +122,7 @@ func Test_secretData(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			keyringData, identityData, err := secretData(context.Background(), tt.destinationNamespace, tt.secret)
+			keyringData, identityData, err := secretData(context.Background(), applicationInfo{destinationNamespace: tt.destinationNamespace}, tt.secret)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("secretData() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -179,15 +184,18 @@ func Test_ensureDecryption(t *testing.T) {
 	bar2 := applicationInfo{
 		name:                 "bar",
 		destinationNamespace: "bar",
-		keyringSecret: secretInfo{
+		keyringSecrets: []secretInfo{{
 			name: "strongbox-secret",
-		},
+		}},
 	}
 	t.Run("no-encrypted-files-with-secret", func(t *testing.T) {
-		err = ensureDecryption(context.Background(), withRemoteBaseTestDir, bar2)
+		report, err := ensureDecryption(context.Background(), withRemoteBaseTestDir, bar2)
 		if err != nil {
 			t.Fatal(err)
 		}
+		if len(report) != 0 {
+			t.Errorf("no files should be decrypted got:%v", report)
+		}
 		// make sure .strongbox_keyring file exists with correct keyring data
 		if !bytes.Contains(getFileContent(t, withRemoteBaseTestDir+"/.strongbox_keyring"), kr) {
 			t.Error(withRemoteBaseTestDir + "/.strongbox_keyring should contain keyring data")
@@ -199,16 +207,28 @@ func Test_ensureDecryption(t *testing.T) {
 	foo := applicationInfo{
 		name:                 "foo",
 		destinationNamespace: "foo",
-		keyringSecret: secretInfo{
+		keyringSecrets: []secretInfo{{
 			name: "strongbox-secret",
-		},
+		}},
 	}
 	t.Run("encrypted-files-with-secret", func(t *testing.T) {
-		err = ensureDecryption(context.Background(), encryptedTestDir1, foo)
+		report, err := ensureDecryption(context.Background(), encryptedTestDir1, foo)
 		if err != nil {
 			t.Fatal(err)
 		}
 
+		keyID := "C8AvbAYJCcZagU1BDfHBgK/lsYM2vkKRkFdLAvu4yBA="
+		wantReport := []decryptedFile{
+			{path: "app/secrets/env_secrets", format: formatLegacy, key: keyID},
+			{path: "app/secrets/kube_secret.yaml", format: formatLegacy, key: keyID},
+			{path: "app/secrets/s1.json", format: formatLegacy, key: keyID},
+			{path: "app/secrets/s2.yaml", format: formatLegacy, key: keyID},
+			{path: "secrets/strongbox-keyring", format: formatLegacy, key: keyID},
+		}
+		if diff := cmp.Diff(wantReport, report, cmp.AllowUnexported(decryptedFile{})); diff != "" {
+			t.Errorf("ensureDecryption() report mismatch (-want +got):\n%s", diff)
+		}
+
 		if !bytes.Contains(getFileContent(t, encryptedTestDir1+"/secrets/strongbox-keyring"), kr) {
 			t.Error(encryptedTestDir1 + "/secrets/strongbox-keyring should contain keyring data")
 		}
@@ -232,13 +252,13 @@ func Test_ensureDecryption(t *testing.T) {
 	baz := applicationInfo{
 		name:                 "foo",
 		destinationNamespace: "baz",
-		keyringSecret: secretInfo{
+		keyringSecrets: []secretInfo{{
 			namespace: "not-baz",
 			name:      "strongbox-secret",
-		},
+		}},
 	}
 	t.Run("encrypted-files-with-secret-from-diff-ns", func(t *testing.T) {
-		err = ensureDecryption(context.Background(), encryptedTestDir2, baz)
+		_, err := ensureDecryption(context.Background(), encryptedTestDir2, baz)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -262,3 +282,175 @@ func Test_ensureDecryption(t *testing.T) {
 	})
 
 }
+
+func Test_strongboxRecursiveDecrypt(t *testing.T) {
+	kr := getFileContent(t, "./testData/app-with-secrets/.keyRing")
+
+	copyTestDir := func(t *testing.T) string {
+		dir := filepath.Join(t.TempDir(), "app")
+		if out, err := exec.Command("cp", "-r", "./testData/app-with-secrets", dir).CombinedOutput(); err != nil {
+			t.Fatalf("%s", out)
+		}
+		return dir
+	}
+
+	t.Run("valid-keyring", func(t *testing.T) {
+		dir := copyTestDir(t)
+		if _, err := strongboxRecursiveDecrypt(context.Background(), dir, kr, repoConfig{}.shouldDecrypt); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(getFileContent(t, dir+"/app/secrets/s2.yaml"), []byte("password: PlainText")) {
+			t.Error("app/secrets/s2.yaml should be decrypted")
+		}
+	})
+
+	// same as strongbox all keys are tried if key of the key-id is missing from keyring
+	t.Run("missing-key-id", func(t *testing.T) {
+		dir := copyTestDir(t)
+		otherKR := []byte(`keyentries:
+- description: other
+  key-id: AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+  key: BmjHbTdlZJEffBdwsbVsEhk1G+wTQGwxwEcRHxDgyTw=
+`)
+		report, err := strongboxRecursiveDecrypt(context.Background(), dir, otherKR, repoConfig{}.shouldDecrypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report) == 0 || report[0].key != "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=" {
+			t.Errorf("report should contain key-id of the key that worked got:%v", report)
+		}
+		if !bytes.Contains(getFileContent(t, dir+"/app/secrets/s2.yaml"), []byte("password: PlainText")) {
+			t.Error("app/secrets/s2.yaml should be decrypted")
+		}
+	})
+
+	t.Run("missing-key-id-wrong-keys", func(t *testing.T) {
+		dir := copyTestDir(t)
+		wrongKR := []byte(`keyentries:
+- description: wrong
+  key-id: AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+  key: AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+`)
+		_, err := strongboxRecursiveDecrypt(context.Background(), dir, wrongKR, repoConfig{}.shouldDecrypt)
+		if err == nil {
+			t.Fatal("expected error for key-id missing from keyring")
+		}
+		if !strings.Contains(err.Error(), "key-id=C8AvbAYJCcZagU1BDfHBgK/lsYM2vkKRkFdLAvu4yBA=") {
+			t.Errorf("error should contain key-id got:%s", err)
+		}
+	})
+
+	t.Run("wrong-key-without-key-id-file", func(t *testing.T) {
+		dir := copyTestDir(t)
+		if err := os.Remove(filepath.Join(dir, strongboxKeyIDFilename)); err != nil {
+			t.Fatal(err)
+		}
+		wrongKR := []byte(`keyentries:
+- description: wrong
+  key-id: C8AvbAYJCcZagU1BDfHBgK/lsYM2vkKRkFdLAvu4yBA=
+  key: AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+`)
+		_, err := strongboxRecursiveDecrypt(context.Background(), dir, wrongKR, repoConfig{}.shouldDecrypt)
+		if err == nil {
+			t.Fatal("expected error for wrong key")
+		}
+		if !strings.Contains(err.Error(), "path="+dir) {
+			t.Errorf("error should contain file path got:%s", err)
+		}
+	})
+}
+
+func Test_smudge(t *testing.T) {
+	home := t.TempDir()
+	if err := os.WriteFile(filepath.Join(home, strongboxKeyringFilename), getFileContent(t, "./testData/app-with-secrets/.keyRing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"encrypted", getFileContent(t, "./testData/app-with-secrets/app/secrets/s2.yaml"), []byte("password: PlainText\n")},
+		{"plain", []byte("foo: bar\n"), []byte("foo: bar\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := smudge(bytes.NewReader(tt.in), &out, home); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(tt.want), out.String()); diff != "" {
+				t.Errorf("smudge() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_strongboxAgeRecursiveDecrypt(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var enc bytes.Buffer
+	aw := armor.NewWriter(&enc)
+	w, err := age.Encrypt(aw, identity.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("PlainText")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	aw.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret"), enc.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := strongboxAgeRecursiveDecrypt(context.Background(), dir, []byte(identity.String()), repoConfig{}.shouldDecrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []decryptedFile{{path: "secret", format: formatAge, key: identity.Recipient().String()}}
+	if diff := cmp.Diff(want, report, cmp.AllowUnexported(decryptedFile{})); diff != "" {
+		t.Errorf("strongboxAgeRecursiveDecrypt() report mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("PlainText", string(getFileContent(t, filepath.Join(dir, "secret")))); diff != "" {
+		t.Errorf("strongboxAgeRecursiveDecrypt() content mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_ensureDecryptionWithLocalKeyring(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	if out, err := exec.Command("cp", "-r", "./testData/app-with-secrets", dir).CombinedOutput(); err != nil {
+		t.Fatalf("%s", out)
+	}
+
+	kubeClient = nil
+	localSecrets = map[string]*v1.Secret{
+		"argocd-voodoobox-strongbox-keyring": localSecret("argocd-voodoobox-strongbox-keyring", map[string][]byte{
+			strongboxKeyringFilename: getFileContent(t, "./testData/app-with-secrets/.keyRing"),
+		}),
+	}
+	defer func() { localSecrets = nil }()
+
+	app := applicationInfo{
+		name:                 "foo",
+		destinationNamespace: "foo",
+		keyringSecrets:       []secretInfo{{name: "argocd-voodoobox-strongbox-keyring"}},
+	}
+	report, err := ensureDecryption(context.Background(), dir, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 5 {
+		t.Errorf("expected 5 decrypted files got:%v", report)
+	}
+	if !bytes.Contains(getFileContent(t, dir+"/app/secrets/s2.yaml"), []byte("PlainText")) {
+		t.Error("app/secrets/s2.yaml should be decrypted")
+	}
+}
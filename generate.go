@@ -1,19 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
 	"filippo.io/age/armor"
 	"github.com/ghodss/yaml"
-	v1 "k8s.io/api/core/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+)
+
+const (
+	gitConfigSBFilterFragment = `[filter "strongbox"]
+	smudge = '%s' strongbox-smudge
+	required = true
+`
 )
 
 func ensureBuild(ctx context.Context, cwd, globalKeyPath, globalKnownHostFile string, app applicationInfo) ([]byte, error) {
@@ -23,13 +38,27 @@ func ensureBuild(ctx context.Context, cwd, globalKeyPath, globalKnownHostFile st
 	// if bases over SSH have been configured.
 	sshCmdEnv := `GIT_SSH_COMMAND=ssh -q -F none -o IdentitiesOnly=yes -o IdentityFile=/dev/null -o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no`
 
+	root := app.config.buildRootPath(cwd)
+
 	kFiles, err := findKustomizeFiles(cwd)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get Kustomize files paths err:%s", err)
 	}
 
 	if len(kFiles) == 0 {
-		return findAndReadYamlFiles(cwd)
+		return findAndReadYamlFiles(root)
+	}
+
+	if err := checkRemoteBases(kFiles, allowedRemoteBases); err != nil {
+		return nil, err
+	}
+	if err := writeRemoteBasesGitConfig(cwd, allowedRemoteBases); err != nil {
+		return nil, err
+	}
+	if app.requirePinnedRefs {
+		if err := checkPinnedRefs(kFiles); err != nil {
+			return nil, err
+		}
 	}
 
 	hasRemoteBase, err := hasSSHRemoteBaseURL(kFiles)
@@ -37,6 +66,8 @@ func ensureBuild(ctx context.Context, cwd, globalKeyPath, globalKnownHostFile st
 		return nil, fmt.Errorf("unable to look for SSH protocol err:%s", err)
 	}
 
+	// ssh is only configured if app's kustomizations use ssh. without it ssh of the nested
+	// remote bases runs without known hosts of HOME (cwd) and fails host key verification
 	if hasRemoteBase {
 		sshCmdEnv, err = setupGitSSH(ctx, cwd, globalKeyPath, globalKnownHostFile, app)
 		if err != nil {
@@ -54,19 +85,55 @@ func ensureBuild(ctx context.Context, cwd, globalKeyPath, globalKnownHostFile st
 	}
 
 	env = append(env, sshCmdEnv)
+	// git should fail instead of prompting for credentials
+	env = append(env, "GIT_TERMINAL_PROMPT=0")
+
+	if app.gitHTTPSSecret.name != "" {
+		if err := setupGitHTTPS(ctx, cwd, app); err != nil {
+			return nil, err
+		}
+	}
+
+	// mirrors must be configured after ssh keys
+	if err := writeRemoteBaseMirrorsGitConfig(cwd, remoteBaseMirrors); err != nil {
+		return nil, err
+	}
 
 	// setup Git config if .strongbox_keyring or .strongbox_identity exits
 	if fileExists(filepath.Join(cwd, strongboxKeyringFilename)) || fileExists(filepath.Join(cwd, strongboxIdentityFilename)) {
 		// setup SB home for kustomize run
 		env = append(env, fmt.Sprintf("STRONGBOX_HOME=%s", cwd))
 
-		// setup git config via `strongbox -git-config`
-		if err := setupGitConfigForSB(ctx, cwd, env); err != nil {
+		// setup git config to use plugin as strongbox smudge filter
+		if err := setupGitConfigForSB(cwd); err != nil {
 			return nil, fmt.Errorf("unable setup git config for strongbox err:%s", err)
 		}
 	}
 
-	return runKustomizeBuild(ctx, cwd, env)
+	var helmCommand string
+	if app.helmEnabled || app.config.Kustomize.EnableHelm {
+		var helmEnv []string
+		helmCommand, helmEnv, err = setupHelm(ctx, cwd, app)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, helmEnv...)
+	}
+
+	// tags can only be differentiated from branches once git is configured to access remote bases
+	if app.requirePinnedRefs {
+		if err := verifyPinnedRefTags(ctx, kFiles, env); err != nil {
+			return nil, err
+		}
+	}
+
+	release, err := setupRemoteBaseCache(ctx, cwd, kFiles, env)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return runKustomizeBuild(ctx, root, kustomizeOptions(helmCommand, app.config.Kustomize), env)
 }
 
 func fileExists(filepath string) bool {
@@ -92,60 +159,179 @@ func findKustomizeFiles(cwd string) ([]string, error) {
 	return kFiles, nil
 }
 
+// hasSSHRemoteBaseURL returns true if any of the kustomization files
+// references remote repository using ssh:// or scp-like user@domain URL
 func hasSSHRemoteBaseURL(kFiles []string) (bool, error) {
-	for _, k := range kFiles {
-		data, err := os.ReadFile(k)
-		if err != nil {
-			return false, err
-		}
-		if bytes.Contains(data, []byte("ssh://")) {
-			return true, nil
+	hosts, err := sshRemoteHosts(kFiles)
+	return len(hosts) > 0, err
+}
+
+// sshRemoteHosts returns sorted list of hosts of all SSH remote references of given kustomization files
+func sshRemoteHosts(kFiles []string) ([]string, error) {
+	refs, err := kustomizationRemoteRefs(kFiles)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for _, r := range refs {
+		if !isSSHURL(r.node.Value) {
+			continue
 		}
+		sections := reRepoURLWithSSH.FindStringSubmatch(r.node.Value)
+		hosts = append(hosts, sections[reRepoURLWithSSH.SubexpIndex("domain")])
 	}
-	return false, nil
+	slices.Sort(hosts)
+	return slices.Compact(hosts), nil
 }
 
-// setupGitConfigForSB will setup git filters to run Strongbox
-func setupGitConfigForSB(ctx context.Context, cwd string, env []string) error {
-	s := exec.CommandContext(ctx, "strongbox", "-git-config")
-	s.Dir = cwd
-	s.Env = env
+// setupGitConfigForSB will setup git filters to decrypt strongbox encrypted
+// files of remote bases using this binary as smudge filter
+func setupGitConfigForSB(cwd string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to get plugin executable path err:%s", err)
+	}
 
-	stderr, err := s.CombinedOutput()
+	return appendGitConfig(cwd, fmt.Sprintf(gitConfigSBFilterFragment, self))
+}
+
+// appendGitConfig appends given config to git config file in cwd.
+// HOME is set to cwd for kustomize run so git will pick it up as global config
+func appendGitConfig(cwd, config string) error {
+	f, err := os.OpenFile(filepath.Join(cwd, ".gitconfig"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		return fmt.Errorf("error running strongbox err:%s ", stderr)
+		return err
 	}
+	defer f.Close()
 
-	return nil
+	_, err = f.WriteString(config)
+	return err
 }
 
-// runKustomizeBuild runs `kustomize build` and returns the generated YAML or an error.
-func runKustomizeBuild(ctx context.Context, cwd string, env []string) ([]byte, error) {
-	k := exec.CommandContext(ctx, "kustomize", "build", ".")
-	k.Dir = cwd
-	k.Env = env
+// kustomizeBuildLock serializes in-process kustomize builds, since kustomize doesn't take
+// env for git and helm commands it runs, env of the build is set on the process.
+var kustomizeBuildLock = make(chan struct{}, 1)
+
+// runKustomizeBuild runs kustomize build in-process and returns the generated YAML or an error.
+// git used by kustomize to fetch remote bases inherits process env so given env is set on the process
+// while holding kustomizeBuildLock. kustomize build can't be cancelled so ctx is only checked before
+// build is started.
+func runKustomizeBuild(ctx context.Context, cwd string, opts *krusty.Options, env []string) ([]byte, error) {
+	select {
+	case kustomizeBuildLock <- struct{}{}:
+		defer func() { <-kustomizeBuildLock }()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("unable to start kustomize build err:%w", ctx.Err())
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("unable to start kustomize build err:%w", err)
+	}
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		// restore original env once build is done
+		if old, ok := os.LookupEnv(k); ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+		if err := os.Setenv(k, v); err != nil {
+			return nil, fmt.Errorf("unable to set env for kustomize build: env=%s err=%s", k, err)
+		}
+	}
+
+	k := krusty.MakeKustomizer(opts)
 
-	k.Stdout = &stdout
-	k.Stderr = &stderr
 	start := time.Now()
-	if err := k.Start(); err != nil {
-		return nil, fmt.Errorf("unable to start kustomize cmd:  duration=%s err=%s", time.Since(start), err)
+	resMap, err := k.Run(filesys.MakeFsOnDisk(), cwd)
+	if err != nil {
+		return nil, &kustomizeBuildError{
+			kustomization: failingKustomization(cwd, err),
+			duration:      time.Since(start),
+			err:           err,
+		}
 	}
-
-	if err := k.Wait(); err != nil {
-		return nil, fmt.Errorf("kustomize command error: duration=%s err=%s", time.Since(start), stderr.String())
+	out, err := resMap.AsYaml()
+	if err != nil {
+		return nil, fmt.Errorf("unable to convert kustomize build output to yaml err:%s", err)
 	}
 
-	logger.Info("kustomize command finished", "duration", time.Since(start))
+	logger.Info("kustomize build finished", "duration", time.Since(start))
 
-	if err := checkSecrets(stdout.Bytes()); err != nil {
+	if err := checkSecrets(out); err != nil {
 		return nil, err
 	}
 
-	return stdout.Bytes(), nil
+	return out, nil
+}
+
+// kustomizeOptions returns krusty options, this are same as defaults of `kustomize build`
+// i.e. files can only be loaded from kustomization root and plugins are disabled.
+// if helmCommand is set its same as `kustomize build --enable-helm --helm-command`
+// load restrictor can be overridden by repo config only if its allowed by server config.
+func kustomizeOptions(helmCommand string, cfg kustomizeConfig) *krusty.Options {
+	opts := krusty.MakeDefaultOptions()
+	// `kustomize build` defaults to legacy order unless sortOptions is set in kustomization
+	opts.Reorder = krusty.ReorderOptionUnspecified
+	opts.LoadRestrictions = types.LoadRestrictionsRootOnly
+	if allowLoadRestrictionsNone && cfg.LoadRestrictor == types.LoadRestrictionsNone.String() {
+		opts.LoadRestrictions = types.LoadRestrictionsNone
+	}
+	opts.PluginConfig = types.DisabledPluginConfig()
+	if helmCommand != "" {
+		opts.PluginConfig.HelmConfig.Enabled = true
+		opts.PluginConfig.HelmConfig.Command = helmCommand
+	}
+	return opts
+}
+
+// kustomizeBuildError is returned when kustomize build fails
+type kustomizeBuildError struct {
+	// kustomization is the path of the kustomization file which failed to build
+	kustomization string
+	duration      time.Duration
+	err           error
+}
+
+func (e *kustomizeBuildError) Error() string {
+	return fmt.Sprintf("kustomize build error: kustomization=%s duration=%s err=%s", e.kustomization, e.duration, e.err)
+}
+
+func (e *kustomizeBuildError) Unwrap() error {
+	return e.err
+}
+
+// failingKustomization returns the deepest kustomization file whose directory
+// is referenced in the build error, defaults to root kustomization file
+func failingKustomization(root string, buildErr error) string {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return root
+	}
+	kFiles, err := findKustomizeFiles(absRoot)
+	if err != nil || len(kFiles) == 0 {
+		return root
+	}
+
+	var failing string
+	for _, k := range kFiles {
+		dir := filepath.Dir(k)
+		if dir == absRoot {
+			if failing == "" {
+				failing = k
+			}
+			continue
+		}
+		// krusty errors contain quoted absolute paths of dirs and files
+		if (strings.Contains(buildErr.Error(), "'"+dir+"'") || strings.Contains(buildErr.Error(), dir+"/")) &&
+			len(dir) >= len(filepath.Dir(failing)) {
+			failing = k
+		}
+	}
+	if failing == "" {
+		return root
+	}
+	return failing
 }
 
 func findAndReadYamlFiles(cwd string) ([]byte, error) {
@@ -167,29 +353,294 @@ func findAndReadYamlFiles(cwd string) ([]byte, error) {
 	return content, nil
 }
 
+// checkSecrets decodes all documents of the kustomize build output and returns an
+// error listing every object which still contains strongbox or age ciphertext.
+// Secret `data` and ConfigMap `binaryData` values are base64 decoded before the check,
+// all other string values of the object (i.e. `stringData`, ConfigMap data, Pod env
+// values or CRD fields) are checked as is. items of `List` kinds are checked individually.
 func checkSecrets(yamlData []byte) error {
-	// Split input YAML into multiple documents by "---"
-	docs := bytes.Split(yamlData, []byte("\n---\n"))
+	objs, err := decodeObjects(yamlData)
+	if err != nil {
+		return err
+	}
+
+	var leaks []string
+	for _, obj := range objs {
+		leaks = append(leaks, findCiphertext(obj)...)
+	}
+	if len(leaks) > 0 {
+		return fmt.Errorf("found ciphertext in build output: %s", strings.Join(leaks, ", "))
+	}
+	return nil
+}
+
+// decodeObjects reads all yaml documents from given data, items of
+// `List` kinds are returned as separate objects
+func decodeObjects(data []byte) ([]map[string]any, error) {
+	var objs []map[string]any
 
-	for _, doc := range docs {
-		if len(bytes.TrimSpace(doc)) == 0 {
-			continue // Skip empty documents
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(data)))
+	for i := 0; ; i++ {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read document: index=%d err:%s", i, err)
 		}
 
-		var secret v1.Secret
-		if err := yaml.Unmarshal(doc, &secret); err != nil {
-			// Unmarshaling will fail for Secret like object, like ConfigMap
+		var obj map[string]any
+		if err := yaml.Unmarshal(doc, &obj); err != nil {
+			return nil, fmt.Errorf("unable to decode document: index=%d err:%s", i, err)
+		}
+		// document with only comments or whitespace
+		if obj == nil {
 			continue
 		}
+		objs = append(objs, flattenList(obj)...)
+	}
+	return objs, nil
+}
 
-		// Check if the decoded document is a Secret
-		if secret.Kind == "Secret" {
-			for key, val := range secret.Data {
-				if bytes.HasPrefix(val, encryptedFilePrefix) || strings.HasPrefix(string(val), armor.Header) {
-					return fmt.Errorf("found ciphertext in Secret: secret=%s key=%s", secret.Name, key)
+func flattenList(obj map[string]any) []map[string]any {
+	kind, _ := obj["kind"].(string)
+	items, ok := obj["items"].([]any)
+	if !ok || !strings.HasSuffix(kind, "List") {
+		return []map[string]any{obj}
+	}
+
+	var objs []map[string]any
+	for _, item := range items {
+		if o, ok := item.(map[string]any); ok {
+			objs = append(objs, flattenList(o)...)
+		}
+	}
+	return objs
+}
+
+// findCiphertext returns description of every field of the object containing ciphertext
+func findCiphertext(obj map[string]any) []string {
+	var leaks []string
+	walkStrings(obj, func(path, val string) (string, bool) {
+		if isCiphertext(val) {
+			leaks = append(leaks, fmt.Sprintf("%s field=%s", objectRef(obj), path))
+		}
+		return val, false
+	})
+	return leaks
+}
+
+// objectRef returns kind, namespace and name of the object in log format
+func objectRef(obj map[string]any) string {
+	kind, _ := obj["kind"].(string)
+	meta, _ := obj["metadata"].(map[string]any)
+	name, _ := meta["name"].(string)
+	namespace, _ := meta["namespace"].(string)
+	return fmt.Sprintf("kind=%s namespace=%s name=%s", kind, namespace, name)
+}
+
+// walkStrings calls fn with field path and value of every string value of the object
+// in sorted key order. values of base64 encoded fields are decoded before calling fn.
+// if fn returns true, the value is replaced with the returned value.
+func walkStrings(obj map[string]any, fn func(path, val string) (string, bool)) {
+	kind, _ := obj["kind"].(string)
+
+	var walk func(path string, v any, encoded bool) (any, bool)
+	walk = func(path string, v any, encoded bool) (any, bool) {
+		switch val := v.(type) {
+		case map[string]any:
+			keys := make([]string, 0, len(val))
+			for k := range val {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				p := k
+				if path != "" {
+					p = path + "." + k
+				}
+				if nv, ok := walk(p, val[k], encoded || isBase64Field(kind, p)); ok {
+					val[k] = nv
+				}
+			}
+		case []any:
+			for i, item := range val {
+				if nv, ok := walk(fmt.Sprintf("%s[%d]", path, i), item, encoded); ok {
+					val[i] = nv
 				}
 			}
+		case string:
+			if encoded {
+				if decoded, err := base64.StdEncoding.DecodeString(val); err == nil {
+					nv, ok := fn(path, string(decoded))
+					return base64.StdEncoding.EncodeToString([]byte(nv)), ok
+				}
+			}
+			return fn(path, val)
 		}
+		return nil, false
 	}
-	return nil
+	walk("", obj, false)
+}
+
+// isBase64Field returns true if values of the given top level field are base64 encoded
+func isBase64Field(kind, path string) bool {
+	return (kind == "Secret" && path == "data") || (kind == "ConfigMap" && path == "binaryData")
+}
+
+func isCiphertext(val string) bool {
+	return strings.Contains(val, string(encryptedFilePrefix)) || strings.Contains(val, armor.Header)
+}
+
+const (
+	plaintextLeakFail   = "fail"
+	plaintextLeakRedact = "redact"
+	plaintextLeakWarn   = "warn"
+
+	// redactedValue replaces values containing decrypted plaintext when leak action is redact
+	redactedValue = "<redacted by argocd-voodoobox-plugin>"
+	// minFingerprintLen is the min length of the secret value to be fingerprinted
+	// shorter values are likely to cause false positives
+	minFingerprintLen = 6
+)
+
+// plaintextFingerprints maps sha256 hash of secret values of decrypted files to file path
+type plaintextFingerprints map[[sha256.Size]byte]string
+
+// fingerprintDecryptedFiles reads all decrypted files and returns fingerprints of the secret values.
+// for kubernetes Secret manifests only values of `data` and `stringData` are used, other YAML or
+// JSON files (i.e. helm values files) are only used as a whole since their values are expected to
+// be rendered into other objects. for any other files whole content along with `key=value` values
+// of each line are used.
+func fingerprintDecryptedFiles(cwd string, files []decryptedFile) (plaintextFingerprints, error) {
+	fps := make(plaintextFingerprints)
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(cwd, f.path))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read decrypted file: path=%s err:%s", f.path, err)
+		}
+		for _, v := range secretValues(data) {
+			fps[sha256.Sum256([]byte(v))] = f.path
+		}
+	}
+	return fps, nil
+}
+
+func secretValues(data []byte) []string {
+	objs, err := decodeObjects(data)
+	if err != nil || len(objs) == 0 {
+		return candidateValues(string(data))
+	}
+
+	var values []string
+	var hasOther bool
+	for _, obj := range objs {
+		if kind, _ := obj["kind"].(string); kind != "Secret" {
+			hasOther = true
+			continue
+		}
+		walkStrings(map[string]any{"kind": "Secret", "data": obj["data"], "stringData": obj["stringData"]}, func(path, val string) (string, bool) {
+			if path != "kind" {
+				values = append(values, candidateValues(val)...)
+			}
+			return val, false
+		})
+	}
+	if v := strings.TrimSpace(string(data)); hasOther && len(v) >= minFingerprintLen {
+		values = append(values, v)
+	}
+	return values
+}
+
+// candidateValues returns trimmed value along with trimmed lines and values of
+// `key=value` and `key: value` lines of the multi line value
+func candidateValues(val string) []string {
+	var values []string
+	seen := make(map[string]bool)
+	add := func(v string) {
+		v = strings.Trim(strings.TrimSpace(v), `"',`)
+		if len(v) >= minFingerprintLen && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+
+	add(val)
+	for _, line := range strings.Split(val, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		add(line)
+		if _, v, ok := strings.Cut(line, "="); ok {
+			add(v)
+		}
+		if _, v, ok := strings.Cut(line, ": "); ok {
+			add(v)
+		}
+	}
+	return values
+}
+
+// guardPlaintextLeaks checks all non Secret objects of the build output for the decrypted
+// plaintext. depending on the action it either returns an error listing every leak, replaces
+// leaked values with redactedValue or only logs the leaks.
+func guardPlaintextLeaks(out []byte, fps plaintextFingerprints, action string) ([]byte, error) {
+	if len(fps) == 0 {
+		return out, nil
+	}
+
+	objs, err := decodeObjects(out)
+	if err != nil {
+		return nil, err
+	}
+
+	var leaks []string
+	for _, obj := range objs {
+		if kind, _ := obj["kind"].(string); kind == "Secret" {
+			continue
+		}
+		walkStrings(obj, func(path, val string) (string, bool) {
+			for _, v := range candidateValues(val) {
+				if file, ok := fps[sha256.Sum256([]byte(v))]; ok {
+					leaks = append(leaks, fmt.Sprintf("%s field=%s file=%s", objectRef(obj), path, file))
+					return redactedValue, true
+				}
+			}
+			return val, false
+		})
+	}
+	if len(leaks) == 0 {
+		return out, nil
+	}
+
+	switch action {
+	case plaintextLeakWarn:
+		for _, l := range leaks {
+			logger.Warn("found decrypted plaintext outside of Secret", "leak", l)
+		}
+		return out, nil
+	case plaintextLeakRedact:
+		for _, l := range leaks {
+			logger.Warn("redacted decrypted plaintext outside of Secret", "leak", l)
+		}
+		return encodeObjects(objs)
+	default:
+		return nil, fmt.Errorf("found decrypted plaintext outside of Secret: %s", strings.Join(leaks, ", "))
+	}
+}
+
+func encodeObjects(objs []map[string]any) ([]byte, error) {
+	var buf bytes.Buffer
+	for i, obj := range objs {
+		data, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode object: %s err:%s", objectRef(obj), err)
+		}
+		if i > 0 {
+			buf.WriteString("---\n")
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
 }
@@ -1,6 +1,18 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
 
 func TestHasSSHRemoteBaseURL(t *testing.T) {
 	type args struct {
@@ -119,3 +131,337 @@ data:
 		}
 	})
 }
+
+func Test_checkSecrets(t *testing.T) {
+	// "# STRONGBOX ENCRYPTED RESOURCE ; See https://github.com/uw-labs/strongbox" base64 encoded
+	sbData := "IyBTVFJPTkdCT1ggRU5DUllQVEVEIFJFU09VUkNFIDsgU2VlIGh0dHBzOi8vZ2l0aHViLmNvbS91dy1sYWJzL3N0cm9uZ2JveAo="
+
+	tests := []struct {
+		name      string
+		yamlData  string
+		wantLeaks []string
+		wantErr   bool
+	}{
+		{
+			"separator-with-comment",
+			`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: test
+data:
+  key: value
+--- # secret
+apiVersion: v1
+kind: Secret
+metadata:
+  name: my-secret
+data:
+  key: ` + sbData + `
+`,
+			[]string{"kind=Secret namespace= name=my-secret field=data.key"},
+			true,
+		},
+		{
+			"list",
+			`apiVersion: v1
+kind: List
+items:
+  - apiVersion: v1
+    kind: Secret
+    metadata:
+      name: my-secret
+      namespace: foo
+    data:
+      key: ` + sbData + `
+`,
+			[]string{"kind=Secret namespace=foo name=my-secret field=data.key"},
+			true,
+		},
+		{
+			"string-data",
+			`apiVersion: v1
+kind: Secret
+metadata:
+  name: my-secret
+stringData:
+  key: |
+    -----BEGIN AGE ENCRYPTED FILE-----
+    YWdlLWVuY3J5cHRpb24ub3JnL3YxCg==
+    -----END AGE ENCRYPTED FILE-----
+`,
+			[]string{"kind=Secret namespace= name=my-secret field=stringData.key"},
+			true,
+		},
+		{
+			"all-offenders",
+			`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-config
+data:
+  app.env: |
+    # STRONGBOX ENCRYPTED RESOURCE ; See https://github.com/uw-labs/strongbox
+    bfV4efgV3pMUIRdpWEsl1BvrS5J4AvGrwuycigF8
+binaryData:
+  bin: ` + sbData + `
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          env:
+            - name: PLAIN
+              value: plain
+            - name: TOKEN
+              value: "# STRONGBOX ENCRYPTED RESOURCE ; See https://github.com/uw-labs/strongbox"
+---
+apiVersion: example.com/v1
+kind: Database
+metadata:
+  name: my-db
+spec:
+  password: "-----BEGIN AGE ENCRYPTED FILE-----"
+`,
+			[]string{
+				"kind=ConfigMap namespace= name=my-config field=binaryData.bin",
+				"kind=ConfigMap namespace= name=my-config field=data.app.env",
+				"kind=Deployment namespace= name=my-app field=spec.template.spec.containers[0].env[1].value",
+				"kind=Database namespace= name=my-db field=spec.password",
+			},
+			true,
+		},
+		{
+			"no-ciphertext",
+			`# comment only document
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: my-secret
+data:
+  key: c2VjcmV0ZGF0YQ==
+stringData:
+  key2: value
+`,
+			nil,
+			false,
+		},
+		{
+			"invalid-yaml",
+			`apiVersion: v1
+kind: [Secret
+`,
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSecrets([]byte(tt.yamlData))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkSecrets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, leak := range tt.wantLeaks {
+				if !strings.Contains(err.Error(), leak) {
+					t.Errorf("checkSecrets() error should contain %q got:%s", leak, err)
+				}
+			}
+			if err != nil && len(tt.wantLeaks) > 0 && strings.Count(err.Error(), "kind=") != len(tt.wantLeaks) {
+				t.Errorf("checkSecrets() error should contain %d leaks got:%s", len(tt.wantLeaks), err)
+			}
+		})
+	}
+}
+
+func Test_runKustomizeBuild(t *testing.T) {
+	t.Run("decrypted-app", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "app")
+		if out, err := exec.Command("cp", "-r", "./testData/app-with-secrets", dir).CombinedOutput(); err != nil {
+			t.Fatalf("%s", out)
+		}
+		if _, err := strongboxRecursiveDecrypt(context.Background(), dir, getFileContent(t, dir+"/.keyRing"), repoConfig{}.shouldDecrypt); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := runKustomizeBuild(context.Background(), dir, kustomizeOptions("", kustomizeConfig{}), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"name: app-bar-nginx", "name: app-bar-files", "name: app-bar-env1", "name: strongbox-keyring"} {
+			if !strings.Contains(string(got), want) {
+				t.Errorf("runKustomizeBuild() output missing %q\n%s", want, got)
+			}
+		}
+		// same as `kustomize build` Secrets should be ordered before Deployments
+		if strings.Index(string(got), "kind: Secret") > strings.Index(string(got), "kind: Deployment") {
+			t.Errorf("runKustomizeBuild() output should use legacy order\n%s", got)
+		}
+	})
+
+	t.Run("nested-kustomization-error", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.Mkdir(filepath.Join(dir, "app"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte("resources:\n- app\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "app", "kustomization.yaml"), []byte("resources:\n- missing.yaml\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := runKustomizeBuild(context.Background(), dir, kustomizeOptions("", kustomizeConfig{}), nil)
+		var buildErr *kustomizeBuildError
+		if !errors.As(err, &buildErr) {
+			t.Fatalf("runKustomizeBuild() expected kustomizeBuildError got:%v", err)
+		}
+		if want := filepath.Join(dir, "app", "kustomization.yaml"); buildErr.kustomization != want {
+			t.Errorf("runKustomizeBuild() kustomization=%s want=%s", buildErr.kustomization, want)
+		}
+	})
+
+	t.Run("env-restored", func(t *testing.T) {
+		t.Setenv("AVP_TEST_BUILD_ENV", "original")
+		if _, err := runKustomizeBuild(context.Background(), t.TempDir(), kustomizeOptions("", kustomizeConfig{}), []string{"AVP_TEST_BUILD_ENV=build"}); err == nil {
+			t.Error("runKustomizeBuild() should fail without kustomization")
+		}
+		if got := os.Getenv("AVP_TEST_BUILD_ENV"); got != "original" {
+			t.Errorf("env should be restored after build got:%s", got)
+		}
+	})
+
+	t.Run("cancelled-while-waiting", func(t *testing.T) {
+		// build in progress
+		kustomizeBuildLock <- struct{}{}
+		defer func() { <-kustomizeBuildLock }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := runKustomizeBuild(ctx, t.TempDir(), kustomizeOptions("", kustomizeConfig{}), nil)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("runKustomizeBuild() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func Test_guardPlaintextLeaks(t *testing.T) {
+	build := func(t *testing.T, leak bool) ([]byte, plaintextFingerprints) {
+		dir := filepath.Join(t.TempDir(), "app")
+		if out, err := exec.Command("cp", "-r", "./testData/app-with-secrets", dir).CombinedOutput(); err != nil {
+			t.Fatalf("%s", out)
+		}
+		report, err := strongboxRecursiveDecrypt(context.Background(), dir, getFileContent(t, dir+"/.keyRing"), repoConfig{}.shouldDecrypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fps, err := fingerprintDecryptedFiles(dir, report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leak {
+			f, err := os.OpenFile(filepath.Join(dir, "app", "kustomization.yaml"), os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(`configMapGenerator:
+  - name: app-bar-config
+    files:
+      - secrets/s2.yaml
+    literals:
+      - LOG_LEVEL=debug
+    options:
+      disableNameSuffixHash: true
+`)
+			f.Close()
+		}
+		out, err := runKustomizeBuild(context.Background(), dir, kustomizeOptions("", kustomizeConfig{}), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out, fps
+	}
+
+	t.Run("no-leak", func(t *testing.T) {
+		out, fps := build(t, false)
+		got, err := guardPlaintextLeaks(out, fps, plaintextLeakFail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(string(out), string(got)); diff != "" {
+			t.Errorf("guardPlaintextLeaks() output should not change (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		out, fps := build(t, true)
+		_, err := guardPlaintextLeaks(out, fps, plaintextLeakFail)
+		want := "kind=ConfigMap namespace= name=app-bar-config field=data.s2.yaml file=app/secrets/s2.yaml"
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("guardPlaintextLeaks() error should contain %q got:%v", want, err)
+		}
+	})
+
+	t.Run("redact", func(t *testing.T) {
+		out, fps := build(t, true)
+		got, err := guardPlaintextLeaks(out, fps, plaintextLeakRedact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs, err := decodeObjects(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range objs {
+			if objectRef(obj) != "kind=ConfigMap namespace= name=app-bar-config" {
+				continue
+			}
+			data := obj["data"].(map[string]any)
+			if data["s2.yaml"] != redactedValue || data["LOG_LEVEL"] != "debug" {
+				t.Errorf("only leaked value should be redacted got:%v", data)
+			}
+			return
+		}
+		t.Errorf("ConfigMap missing from output\n%s", got)
+	})
+
+	t.Run("warn", func(t *testing.T) {
+		out, fps := build(t, true)
+		got, err := guardPlaintextLeaks(out, fps, plaintextLeakWarn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, got) {
+			t.Errorf("guardPlaintextLeaks() output should not change with warn action")
+		}
+	})
+}
+
+func Test_secretValues(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"env", "# comment\nPASSWORD=PlainText\nUSER=me\n", []string{"# comment\nPASSWORD=PlainText\nUSER=me", "PASSWORD=PlainText", "PlainText", "USER=me"}},
+		// values of other YAML or JSON files are expected in the output so only whole file is used
+		{"json", `{"password": "PlainText"}`, []string{`{"password": "PlainText"}`}},
+		{"helm-values", "replicaCount: 2\nimage:\n  repository: org/app-image\n", []string{"replicaCount: 2\nimage:\n  repository: org/app-image"}},
+		{
+			"kube-secret",
+			"apiVersion: v1\nkind: Secret\nmetadata:\n  name: app-bar-password\ndata:\n  TOKEN: c2VjcmV0ZGF0YQ==\nstringData:\n  PASSWORD: PlainText\n",
+			[]string{"secretdata", "PlainText"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, secretValues([]byte(tt.data))); diff != "" {
+				t.Errorf("secretValues() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	gitCredentialsFilename = ".git-credentials"
+	// gitHTTPSDefaultUsername is used if username is not set for the host
+	// GitHub requires it for installation tokens and other forges accept any username for tokens
+	gitHTTPSDefaultUsername = "x-access-token"
+
+	gitConfigCredentialFragment = `[credential]
+	helper = store --file '%s'
+`
+)
+
+// gitHTTPSCredential is the credential of a single host of git https secret
+type gitHTTPSCredential struct {
+	host     string
+	username string
+	token    string
+}
+
+// setupGitHTTPS reads git https secret and configures git credential helper in
+// the HOME=cwd gitconfig so that remote bases can be fetched over HTTPS using tokens.
+// each key of the secret is a host and value is either `token` or `username:token`.
+// if secret contains GitHub App credentials, installation token is used for GitHub host.
+func setupGitHTTPS(ctx context.Context, cwd string, app applicationInfo) error {
+	sec, err := secret(ctx, app, app.gitHTTPSSecret)
+	if err != nil {
+		// https secret is optional as public repositories do not need credentials
+		if errors.Is(err, errNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	creds, err := parseGitHTTPSCredentials(sec.Data)
+	if err != nil {
+		return fmt.Errorf("unable to parse git https secret: secret=%s err:%s", app.gitHTTPSSecret.name, err)
+	}
+
+	ghApp, err := parseGitHubApp(sec.Data)
+	if err != nil {
+		return fmt.Errorf("unable to parse git https secret: secret=%s err:%s", app.gitHTTPSSecret.name, err)
+	}
+	if ghApp != nil {
+		if slices.ContainsFunc(creds, func(c gitHTTPSCredential) bool { return c.host == ghApp.host }) {
+			return fmt.Errorf("both token and github app credentials are set for the host: secret=%s host=%s", app.gitHTTPSSecret.name, ghApp.host)
+		}
+		token, err := ghApp.token(ctx, time.Now())
+		if err != nil {
+			return err
+		}
+		creds = append(creds, gitHTTPSCredential{host: ghApp.host, username: gitHTTPSDefaultUsername, token: token})
+	}
+
+	return writeGitCredentials(cwd, creds)
+}
+
+func parseGitHTTPSCredentials(data map[string][]byte) ([]gitHTTPSCredential, error) {
+	var creds []gitHTTPSCredential
+	for host, v := range data {
+		// github app credentials are handled separately
+		if strings.HasPrefix(host, "github-app-") {
+			continue
+		}
+		if host == "" || strings.ContainsAny(host, "/@") {
+			return nil, fmt.Errorf("invalid host: host=%s", host)
+		}
+
+		username, token, ok := strings.Cut(strings.TrimSpace(string(v)), ":")
+		if !ok {
+			username, token = gitHTTPSDefaultUsername, username
+		}
+		if username == "" || token == "" {
+			return nil, fmt.Errorf("username and token are required: host=%s", host)
+		}
+		creds = append(creds, gitHTTPSCredential{host: host, username: username, token: token})
+	}
+
+	sort.Slice(creds, func(i, j int) bool { return creds[i].host < creds[j].host })
+	return creds, nil
+}
+
+// writeGitCredentials writes given credentials in git credential store format and
+// configures git to use it
+func writeGitCredentials(cwd string, creds []gitHTTPSCredential) error {
+	if len(creds) == 0 {
+		return nil
+	}
+
+	var lines []string
+	for _, c := range creds {
+		u := url.URL{Scheme: "https", User: url.UserPassword(c.username, c.token), Host: c.host}
+		lines = append(lines, u.String())
+	}
+
+	credsFile := filepath.Join(cwd, gitCredentialsFilename)
+	if err := os.WriteFile(credsFile, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("unable to write git credentials file err:%s", err)
+	}
+
+	return appendGitConfig(cwd, fmt.Sprintf(gitConfigCredentialFragment, credsFile))
+}
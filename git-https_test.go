@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_parseGitHTTPSCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string][]byte
+		want    []gitHTTPSCredential
+		wantErr bool
+	}{
+		{
+			"valid",
+			map[string][]byte{
+				"github.com":        []byte("ghp_token\n"),
+				"gitlab.example.io": []byte("oauth2:glpat-token"),
+			},
+			[]gitHTTPSCredential{
+				{host: "github.com", username: gitHTTPSDefaultUsername, token: "ghp_token"},
+				{host: "gitlab.example.io", username: "oauth2", token: "glpat-token"},
+			},
+			false,
+		},
+		{"empty-token", map[string][]byte{"github.com": []byte("user:")}, nil, true},
+		{"url-as-host", map[string][]byte{"https://github.com/org": []byte("token")}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGitHTTPSCredentials(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGitHTTPSCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(gitHTTPSCredential{})); diff != "" {
+				t.Errorf("parseGitHTTPSCredentials() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// newGitHTTPServer serves bare repositories of the given dir over HTTPS using
+// git-http-backend, all requests must use basic auth with given username and token
+func newGitHTTPServer(t *testing.T, root, username, token string) *httptest.Server {
+	t.Helper()
+	out, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(out)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != token {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newBareRepo creates bare repository `repo.git` in given dir containing a kustomize base
+func newBareRepo(t *testing.T, root string) {
+	t.Helper()
+	newBareRepoWithFiles(t, root, "repo.git", map[string]string{
+		"base/kustomization.yaml": "resources:\n  - configmap.yaml\n",
+		"base/configmap.yaml":     "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: remote-base\ndata:\n  foo: bar\n",
+	})
+}
+
+// newBareRepoWithFiles creates bare repository with given name and files in given dir
+func newBareRepoWithFiles(t *testing.T, root, repoName string, files map[string]string) {
+	t.Helper()
+	work := t.TempDir()
+	for name, content := range files {
+		os.MkdirAll(filepath.Join(work, filepath.Dir(name)), 0700)
+		if err := os.WriteFile(filepath.Join(work, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"-C", work, "init", "-q", "-b", "main"},
+		{"-C", work, "add", "."},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "base"},
+		{"clone", "-q", "--bare", work, filepath.Join(root, repoName)},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+}
+
+func Test_gitHTTPSRemoteBase(t *testing.T) {
+	root := t.TempDir()
+	newBareRepo(t, root)
+	srv := newGitHTTPServer(t, root, "user", "s3cr3t")
+	host := strings.TrimPrefix(srv.URL, "https://")
+	// test server uses self signed certificate
+	t.Setenv("GIT_SSL_NO_VERIFY", "true")
+
+	newApp := func(t *testing.T) string {
+		dir := t.TempDir()
+		k := "resources:\n  - " + srv.URL + "/repo.git//base?ref=main\n"
+		if err := os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(k), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-https", Namespace: "foo"},
+			Data:       map[string][]byte{host: []byte("user:s3cr3t")},
+		},
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-https", Namespace: "shared"},
+			Data:       map[string][]byte{host: []byte("user:s3cr3t")},
+		},
+	)
+
+	t.Run("with-credentials", func(t *testing.T) {
+		app := applicationInfo{name: "foo", destinationNamespace: "foo", gitHTTPSSecret: secretInfo{name: "argocd-voodoobox-git-https"}}
+		got, err := ensureBuild(context.Background(), newApp(t), "", "", app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), "name: remote-base") {
+			t.Errorf("remote base resources missing from output\n%s", got)
+		}
+	})
+
+	t.Run("without-credentials", func(t *testing.T) {
+		app := applicationInfo{name: "foo", destinationNamespace: "foo"}
+		if _, err := ensureBuild(context.Background(), newApp(t), "", "", app); err == nil {
+			t.Error("build should fail without credentials")
+		}
+	})
+
+	t.Run("namespace-not-allowed", func(t *testing.T) {
+		app := applicationInfo{name: "foo", destinationNamespace: "foo", gitHTTPSSecret: secretInfo{name: "argocd-voodoobox-git-https", namespace: "shared"}}
+		_, err := ensureBuild(context.Background(), newApp(t), "", "", app)
+		if err == nil || !strings.Contains(err.Error(), "not allowed to use Secret") {
+			t.Errorf("build should fail if namespace is not allowed got:%v", err)
+		}
+	})
+}
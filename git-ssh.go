@@ -1,39 +1,61 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"unicode/utf8"
+
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
 	hostFragment = `Host %s
     HostName %s
     IdentitiesOnly yes
-    IdentityFile %s
-    User git
+%s    User git
 `
 	singleKeyHostFragment = `Host *
     IdentitiesOnly yes
-    IdentityFile %s
-    User git
+%s    User git
+`
+	identityFragment = `    IdentityFile %s
+`
+	certificateFragment = `    CertificateFile %s
 `
+
+	// git ssh secret can contain OpenSSH certificate and passphrase of the
+	// private key using following suffixes on the key name
+	sshCertSuffix       = "-cert.pub"
+	sshPassphraseSuffix = ".passphrase"
 )
 
 var (
 	reKeyName        = regexp.MustCompile(`#.*?argocd-voodoobox-plugin:\s*?(?P<keyName>\w+)`)
-	reRepoURLWithSSH = regexp.MustCompile(`(?P<beginning>^\s*-\s*(?:ssh:\/\/)?)(?P<user>\w.+?@)?(?P<domain>\w.+?)(?P<repoDetails>[\/:].*$)`)
+	reRepoURLWithSSH = regexp.MustCompile(`(?P<beginning>^\s*(?:-\s*)?(?:ssh:\/\/)?)(?P<user>\w.+?@)?(?P<domain>\w.+?)(?P<repoDetails>[\/:].*$)`)
 )
 
 func setupGitSSH(ctx context.Context, cwd, globalKeyPath, globalKnownHostFile string, app applicationInfo) (string, error) {
-	knownHostsFragment := `-o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no`
+	// hosts must be read before kustomization files are updated with key names
+	kFiles, err := findKustomizeFiles(cwd)
+	if err != nil {
+		return "", fmt.Errorf("unable to get Kustomize files paths err:%s", err)
+	}
+	hosts, err := sshRemoteHosts(kFiles)
+	if err != nil {
+		return "", err
+	}
 
 	sshDir := filepath.Join(cwd, ".ssh")
 	if err := os.Mkdir(sshDir, 0700); err != nil {
@@ -43,19 +65,28 @@ func setupGitSSH(ctx context.Context, cwd, globalKeyPath, globalKnownHostFile st
 
 	// keyFilePaths holds key name and path values
 	var keyFilePaths = make(map[string]string)
+	// certFilePaths holds key name and path of its certificate as values
+	var certFilePaths = make(map[string]string)
 	// keyFilePaths holds key name and domain it should be used for as values
 	var keyedDomain = make(map[string]string)
+	// repoMap holds the mapping of remote repositories to keys from git ssh secret
+	var repoMap []repoMapEntry
+	// mirrorHosts holds the remote base mirror hosts and the keys they should be used with
+	var mirrorHosts []repoMapEntry
 	var userKnownHostFile string
 
 	// Using own SSH key
 	if app.gitSSHSecret.name != "" {
-		sec, err := secret(ctx, app.destinationNamespace, app.gitSSHSecret)
+		sec, err := secret(ctx, app, app.gitSSHSecret)
 		if err != nil {
 			return "", err
 		}
 
 		// write ssh data to ssh dir
 		for k, v := range sec.Data {
+			if k == repoMapKey {
+				continue
+			}
 			if k == "known_hosts" {
 				if err := os.WriteFile(filepath.Join(sshDir, k), v, 0600); err != nil {
 					return "", fmt.Errorf("unable to write known_hosts to temp file err:%s", err)
@@ -63,49 +94,107 @@ func setupGitSSH(ctx context.Context, cwd, globalKeyPath, globalKnownHostFile st
 				userKnownHostFile = sshDir + `/known_hosts`
 				continue
 			}
+			// certificates and passphrases are handled along with the private key
+			if strings.HasSuffix(k, sshCertSuffix) || strings.HasSuffix(k, sshPassphraseSuffix) {
+				continue
+			}
+
 			// if key is not known_hosts then its assumed to be private keys
-			kfn := filepath.Join(sshDir, k)
-			// if the file containing the SSH key does not have a
-			// newline at the end, ssh does not complain about it but
-			// the key will not work properly
-			if !bytes.HasSuffix(v, []byte("\n")) {
-				v = append(v, byte('\n'))
+			key, err := parsePrivateKey(k, v, sec.Data[k+sshPassphraseSuffix])
+			if err != nil {
+				return "", err
 			}
+			kfn := filepath.Join(sshDir, k)
 			keyFilePaths[k] = kfn
-			if err := os.WriteFile(kfn, v, 0600); err != nil {
+			if err := os.WriteFile(kfn, key.pem, 0600); err != nil {
 				return "", fmt.Errorf("unable to write key to temp file err:%s", err)
 			}
+
+			cert, ok := sec.Data[k+sshCertSuffix]
+			if !ok {
+				continue
+			}
+			if err := verifyCertificate(k, cert, key.signer); err != nil {
+				return "", err
+			}
+			cfn := filepath.Join(sshDir, k+sshCertSuffix)
+			certFilePaths[k] = cfn
+			if err := os.WriteFile(cfn, cert, 0600); err != nil {
+				return "", fmt.Errorf("unable to write certificate to temp file err:%s", err)
+			}
+		}
+
+		// certificates and passphrases must belong to a key
+		for k := range sec.Data {
+			for _, suffix := range []string{sshCertSuffix, sshPassphraseSuffix} {
+				if name, ok := strings.CutSuffix(k, suffix); ok && sec.Data[name] == nil {
+					return "", fmt.Errorf("private key is missing from git ssh secret: key=%s entry=%s", name, k)
+				}
+			}
+		}
+
+		if data, ok := sec.Data[repoMapKey]; ok {
+			repoMap, err = parseRepoMap(data)
+			if err != nil {
+				return "", fmt.Errorf("unable to parse repo map of git ssh secret err:%s", err)
+			}
+			hosts, err := writeRepoMapGitConfig(cwd, sshDir, repoMap, remoteBaseMirrors)
+			if err != nil {
+				return "", err
+			}
+			mirrorHosts = append(mirrorHosts, hosts...)
+		}
+
+		if len(remoteBaseMirrors) > 0 {
+			hosts, err := writeKeyedMirrorsGitConfig(cwd, sshDir, remoteBaseMirrors, slices.Collect(maps.Keys(keyFilePaths)))
+			if err != nil {
+				return "", err
+			}
+			mirrorHosts = append(mirrorHosts, hosts...)
 		}
 
-		keyedDomain, err = processKustomizeFiles(cwd)
+		keyedDomain, err = processKustomizeFiles(cwd, app.config.GitSSH.Keys)
 		if err != nil {
 			return "", fmt.Errorf("unable to updated kustomize files err:%s", err)
 		}
 	}
 
-	body, err := constructSSHConfig(keyFilePaths, keyedDomain, globalKeyPath)
+	body, err := constructSSHConfig(keyFilePaths, certFilePaths, keyedDomain, append(repoMap, mirrorHosts...), globalKeyPath)
 	if err != nil {
 		return "", err
 	}
+	// hosts not in the allowlist must be checked last as ssh uses first obtained value
+	if d := sshDisallowedHosts(mirroredRemoteBases(allowedRemoteBases, remoteBaseMirrors)); d != "" {
+		body = append(body, []byte("\n"+d)...)
+	}
 	if err := os.WriteFile(sshConfigFilename, body, 0600); err != nil {
 		return "", err
 	}
 
-	switch {
-	case globalKnownHostFile != "" && userKnownHostFile != "":
-		knownHostsFragment = `-o UserKnownHostsFile=` + globalKnownHostFile + ` -o UserKnownHostsFile=` + userKnownHostFile
-	case globalKnownHostFile != "":
-		knownHostsFragment = `-o UserKnownHostsFile=` + globalKnownHostFile
-	case userKnownHostFile != "":
-		knownHostsFragment = `-o UserKnownHostsFile=` + userKnownHostFile
+	var knownHostFiles []string
+	if globalKnownHostFile != "" {
+		knownHostFiles = append(knownHostFiles, globalKnownHostFile)
+	}
+	if userKnownHostFile != "" {
+		knownHostFiles = append(knownHostFiles, userKnownHostFile)
+	}
+	if gitSSHStrictHostKeyChecking {
+		builtin, err := writeBuiltinKnownHosts(sshDir)
+		if err != nil {
+			return "", err
+		}
+		knownHostFiles = append(knownHostFiles, builtin)
+		if err := verifyKnownHosts(hosts, knownHostFiles); err != nil {
+			return "", err
+		}
 	}
 
-	return fmt.Sprintf(`GIT_SSH_COMMAND=ssh -q -F %s %s`, sshConfigFilename, knownHostsFragment), nil
+	return fmt.Sprintf(`GIT_SSH_COMMAND=ssh -q -F %s %s`, sshConfigFilename, knownHostsOptions(knownHostFiles, gitSSHStrictHostKeyChecking)), nil
 }
 
 // processKustomizeFiles finds all Kustomization files by walking the repo dir.
 // For each Kustomization file, it will replace remote base host
-func processKustomizeFiles(tmpRepoDir string) (map[string]string, error) {
+func processKustomizeFiles(tmpRepoDir string, repoKeys []repoKey) (map[string]string, error) {
 	kFiles := []string{}
 	keyedDomain := make(map[string]string)
 
@@ -129,9 +218,9 @@ func processKustomizeFiles(tmpRepoDir string) (map[string]string, error) {
 		}
 		defer in.Close()
 
-		kd, out, err := updateRepoBaseAddresses(in)
+		kd, out, err := updateRepoBaseAddresses(in, repoKeys)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("unable to update kustomization: path=%s err:%s", k, err)
 		}
 		if len(kd) > 0 {
 			if err := os.WriteFile(k, out, 0600); err != nil {
@@ -145,54 +234,215 @@ func processKustomizeFiles(tmpRepoDir string) (map[string]string, error) {
 	return keyedDomain, nil
 }
 
-// updateRepoBaseAddresses will read given kustomize file line by line trying to find KA key
-// comment `# argocd-voodoobox-plugin: key_foo`, we then attempt to replace the domain on
-// the next line by injecting given key name into domain, resulting in
-// `key_foo_github_com`. We must not use `.` - as it breaks Host matching in
-// .ssh/config. it will return map of key and domains it replaced so that ssh config file can be updated
-func updateRepoBaseAddresses(in io.Reader) (map[string]string, []byte, error) {
-	keyedDomains := make(map[string]string)
-	var out []byte
+// kustomizationRef is a scalar node of kustomization file which can reference remote repository
+type kustomizationRef struct {
+	node *yaml.Node
+	// fieldLine is the line of the kustomization field containing the reference
+	fieldLine int
+	// field is the name of the kustomization field containing the reference
+	field string
+}
+
+// keyAnnotation is the `# argocd-voodoobox-plugin: key_foo` comment
+type keyAnnotation struct {
+	key    string
+	line   int
+	column int
+}
+
+// updateRepoBaseAddresses parses given kustomization file and finds all remote references of
+// `resources`, `components`, `bases` and `helmCharts[].repo` fields. For each reference with
+// key comment `# argocd-voodoobox-plugin: key_foo` above or on the same line, we then attempt
+// to replace the domain of the reference by injecting given key name into domain, resulting in
+// `key_foo_github_com`. We must not use `.` - as it breaks Host matching in .ssh/config.
+// if there is no key comment, key is looked up from given repo keys using remote base URL.
+// references are replaced in place so formatting and comments of the file are preserved.
+// it will return map of key and domains it replaced so that ssh config file can be updated
+func updateRepoBaseAddresses(in io.Reader, repoKeys []repoKey) (map[string]string, []byte, error) {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("unable to parse kustomization err:%s", err)
+	}
 
-	scanner := bufio.NewScanner(in)
-	keyName := ""
-	for scanner.Scan() {
-		l := scanner.Text()
+	refs := kustomizationRefs(&doc)
+	annotations := keyAnnotations(data, &doc)
 
+	// keys holds key name for the index of the ref
+	keys := make(map[int]string)
+	var errs []string
+	for _, a := range annotations {
+		i := slices.IndexFunc(refs, func(r kustomizationRef) bool {
+			return r.node.Line > a.line || (r.node.Line == a.line && r.node.Column < a.column)
+		})
 		switch {
+		case i == -1 || a.line < refs[i].fieldLine:
+			errs = append(errs, fmt.Sprintf("line=%d column=%d key=%s err:no remote base found after key comment", a.line, a.column, a.key))
+		case !isSSHURL(refs[i].node.Value):
+			errs = append(errs, fmt.Sprintf("line=%d column=%d key=%s err:remote base is not a valid SSH URL: url=%s", a.line, a.column, a.key, refs[i].node.Value))
+		case keys[i] != "":
+			errs = append(errs, fmt.Sprintf("line=%d column=%d key=%s err:remote base already has key comment: key=%s", a.line, a.column, a.key, keys[i]))
+		default:
+			keys[i] = a.key
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("unable to apply key comments: %s", strings.Join(errs, ", "))
+	}
 
-		case reKeyName.MatchString(l):
-			// copy key
-			s := reKeyName.FindStringSubmatch(l)
-			if len(s) == 2 {
-				keyName = s[reKeyName.SubexpIndex("keyName")]
+	keyedDomains := make(map[string]string)
+	lines := strings.Split(string(data), "\n")
+	// replace in reverse order so that columns of the refs on same line stay valid
+	for i := len(refs) - 1; i >= 0; i-- {
+		node := refs[i].node
+		keyName, ok := keys[i]
+		if !ok && len(repoKeys) > 0 {
+			keyName, ok = lookupRepoKey(node.Value, repoKeys)
+		}
+		if !ok {
+			continue
+		}
+
+		newURL, domain, err := replaceDomainWithConfigHostName(node.Value, keyName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing remote base url: line=%d column=%d err:%s", node.Line, node.Column, err)
+		}
+		if err := replaceScalar(lines, node, newURL); err != nil {
+			return nil, nil, err
+		}
+		keyedDomains[keyName] = domain
+	}
+
+	return keyedDomains, []byte(strings.Join(lines, "\n")), nil
+}
+
+// kustomizationRefs returns scalar nodes of the fields which can
+// reference remote repositories in the document order
+func kustomizationRefs(doc *yaml.Node) []kustomizationRef {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	root := doc.Content[0]
+
+	var refs []kustomizationRef
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if value.Kind != yaml.SequenceNode {
+			continue
+		}
+		switch key.Value {
+		case "resources", "components", "bases":
+			for _, item := range value.Content {
+				if item.Kind == yaml.ScalarNode {
+					refs = append(refs, kustomizationRef{item, key.Line, key.Value})
+				}
 			}
+		case "helmCharts":
+			for _, chart := range value.Content {
+				if chart.Kind != yaml.MappingNode {
+					continue
+				}
+				for j := 0; j+1 < len(chart.Content); j += 2 {
+					if chart.Content[j].Value == "repo" && chart.Content[j+1].Kind == yaml.ScalarNode {
+						refs = append(refs, kustomizationRef{chart.Content[j+1], key.Line, key.Value})
+					}
+				}
+			}
+		}
+	}
 
-		case keyName != "" && !reRepoURLWithSSH.MatchString(l):
-			return nil, nil, fmt.Errorf("found key reference in comment but next remote base url is not a valid SSH URL")
+	slices.SortFunc(refs, func(a, b kustomizationRef) int {
+		if a.node.Line != b.node.Line {
+			return a.node.Line - b.node.Line
+		}
+		return a.node.Column - b.node.Column
+	})
+	return refs
+}
 
-		// referencing key is not mandatory since only 1 key can be used for all private base
-		// case keyName == "" && reRepoAddressWithSSH.MatchString(l):
-		// 	return nil, nil, fmt.Errorf("found remote base url with ssh protocol without referenced key comment above")
+// kustomizationRemoteRef is the remote repository reference of the kustomization file
+type kustomizationRemoteRef struct {
+	kustomizationRef
+	// path is the path of the kustomization file
+	path string
+}
 
-		case keyName != "" && reRepoURLWithSSH.MatchString(l):
-			// If Key if found replace domain
-			new, domain, err := replaceDomainWithConfigHostName(l, keyName)
-			if err != nil {
-				return nil, nil, fmt.Errorf("error parsing remote base url")
+// kustomizationRemoteRefs parses given kustomization files and returns their references
+// of remote repositories in the document order. helm chart repositories are also returned
+// so callers only interested in git repositories must skip `helmCharts` field.
+func kustomizationRemoteRefs(kFiles []string) ([]kustomizationRemoteRef, error) {
+	var refs []kustomizationRemoteRef
+	for _, k := range kFiles {
+		data, err := os.ReadFile(k)
+		if err != nil {
+			return nil, err
+		}
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("unable to parse kustomization: path=%s err:%s", k, err)
+		}
+		for _, r := range kustomizationRefs(&doc) {
+			if isRemoteRef(filepath.Dir(k), r.node.Value) {
+				refs = append(refs, kustomizationRemoteRef{r, k})
 			}
+		}
+	}
+	return refs, nil
+}
 
-			l = new
-			keyedDomains[keyName] = domain
+// keyAnnotations returns all key comments of the document with their position.
+// only comments which are part of the parsed document are used so that
+// `#` inside of values is not considered as comment
+func keyAnnotations(data []byte, doc *yaml.Node) []keyAnnotation {
+	var comments strings.Builder
+	var collect func(n *yaml.Node)
+	collect = func(n *yaml.Node) {
+		comments.WriteString(n.HeadComment + "\n" + n.LineComment + "\n" + n.FootComment + "\n")
+		for _, c := range n.Content {
+			collect(c)
+		}
+	}
+	collect(doc)
 
-			keyName = ""
+	var annotations []keyAnnotation
+	for i, l := range strings.Split(string(data), "\n") {
+		loc := reKeyName.FindStringSubmatchIndex(l)
+		if loc == nil || !strings.Contains(comments.String(), strings.TrimSpace(l[loc[0]:])) {
+			continue
 		}
+		annotations = append(annotations, keyAnnotation{
+			key:    l[loc[2]:loc[3]],
+			line:   i + 1,
+			column: utf8.RuneCountInString(l[:loc[0]]) + 1,
+		})
+	}
+	return annotations
+}
+
+// replaceScalar replaces value of the given scalar node in the lines of the
+// document keeping the quoting style of the value
+func replaceScalar(lines []string, node *yaml.Node, value string) error {
+	quote := ""
+	switch node.Style {
+	case yaml.DoubleQuotedStyle:
+		quote = `"`
+	case yaml.SingleQuotedStyle:
+		quote = `'`
+	}
+	old := []rune(quote + node.Value + quote)
 
-		out = append(out, l...)
-		out = append(out, "\n"...)
+	line := []rune(lines[node.Line-1])
+	start := node.Column - 1
+	if start+len(old) > len(line) || string(line[start:start+len(old)]) != string(old) {
+		return fmt.Errorf("unable to replace remote base url: line=%d column=%d url=%s", node.Line, node.Column, node.Value)
 	}
 
-	return keyedDomains, out, nil
+	lines[node.Line-1] = string(line[:start]) + quote + value + quote + string(line[start+len(old):])
+	return nil
 }
 
 func replaceDomainWithConfigHostName(original string, keyName string) (string, string, error) {
@@ -211,34 +461,159 @@ func replaceDomainWithConfigHostName(original string, keyName string) (string, s
 	domain := sections[reRepoURLWithSSH.SubexpIndex("domain")]
 	newURL := sections[reRepoURLWithSSH.SubexpIndex("beginning")] +
 		sections[reRepoURLWithSSH.SubexpIndex("user")] +
-		keyName + "_" + strings.ReplaceAll(domain, ".", "_") +
+		hostAlias(keyName, domain) +
 		sections[reRepoURLWithSSH.SubexpIndex("repoDetails")]
 
 	return newURL, domain, nil
 }
 
-func constructSSHConfig(keyFilePaths map[string]string, keyedDomain map[string]string, globalKeyPath string) ([]byte, error) {
+// hostAlias returns the ssh config Host of the key and domain
+func hostAlias(keyName, domain string) string {
+	return keyName + "_" + strings.ReplaceAll(domain, ".", "_")
+}
+
+// isSSHURL returns true if given remote base URL is either ssh:// or user@domain URL
+func isSSHURL(url string) bool {
+	// other schemes i.e. https://user@domain are not SSH
+	if strings.Contains(url, "://") && !strings.HasPrefix(url, "ssh://") {
+		return false
+	}
+	sections := reRepoURLWithSSH.FindStringSubmatch(url)
+	if len(sections) != 5 {
+		return false
+	}
+	return strings.Contains(sections[reRepoURLWithSSH.SubexpIndex("beginning")], "ssh://") ||
+		sections[reRepoURLWithSSH.SubexpIndex("user")] != ""
+}
+
+// lookupRepoKey returns the key name of the longest repo prefix matching given SSH remote base URL
+func lookupRepoKey(url string, repoKeys []repoKey) (string, bool) {
+	// only SSH URLs can use keys
+	if !isSSHURL(url) {
+		return "", false
+	}
+	sections := reRepoURLWithSSH.FindStringSubmatch(url)
+	repoURL := sections[reRepoURLWithSSH.SubexpIndex("domain")] + "/" +
+		strings.TrimLeft(sections[reRepoURLWithSSH.SubexpIndex("repoDetails")], "/:")
+
+	var key, repo string
+	for _, rk := range repoKeys {
+		if strings.HasPrefix(repoURL, rk.Repo) && len(rk.Repo) > len(repo) {
+			key, repo = rk.Key, rk.Repo
+		}
+	}
+	return key, key != ""
+}
+
+func constructSSHConfig(keyFilePaths, certFilePaths, keyedDomain map[string]string, repoMap []repoMapEntry, globalKeyPath string) ([]byte, error) {
+	identity := func(keyName, keyFilePath string) string {
+		fragment := fmt.Sprintf(identityFragment, keyFilePath)
+		if certFilePath, ok := certFilePaths[keyName]; ok {
+			fragment += fmt.Sprintf(certificateFragment, certFilePath)
+		}
+		return fragment
+	}
+
 	hostFragments := []string{}
+	hosts := make(map[string]bool)
 	for keyName, domain := range keyedDomain {
 		keyFilePath, ok := keyFilePaths[keyName]
 		if !ok {
 			return nil, fmt.Errorf("unable to find path for key:%s, please make sure all referenced keys are added to git ssh secret", keyName)
 		}
 
-		host := keyName + "_" + strings.ReplaceAll(domain, ".", "_")
-		hostFragments = append(hostFragments, fmt.Sprintf(hostFragment, host, domain, keyFilePath))
+		host := hostAlias(keyName, domain)
+		hostFragments = append(hostFragments, fmt.Sprintf(hostFragment, host, domain, identity(keyName, keyFilePath)))
+		hosts[host] = true
+	}
+
+	for _, e := range repoMap {
+		keyFilePath, ok := keyFilePaths[e.key]
+		if !ok {
+			return nil, fmt.Errorf("unable to find path for key:%s of repo map, please make sure all referenced keys are added to git ssh secret", e.key)
+		}
+
+		host := hostAlias(e.key, e.host)
+		if hosts[host] {
+			continue
+		}
+		hostFragments = append(hostFragments, fmt.Sprintf(hostFragment, host, e.host, identity(e.key, keyFilePath)))
+		hosts[host] = true
 	}
 
 	if globalKeyPath != "" {
-		hostFragments = append(hostFragments, fmt.Sprintf(singleKeyHostFragment, globalKeyPath))
+		hostFragments = append(hostFragments, fmt.Sprintf(singleKeyHostFragment, fmt.Sprintf(identityFragment, globalKeyPath)))
 	}
 
 	// if global key is not provided and  user provides only 1 key then also use that for all host
 	if len(keyFilePaths) == 1 && globalKeyPath == "" {
-		for _, keyFilePath := range keyFilePaths {
-			hostFragments = append(hostFragments, fmt.Sprintf(singleKeyHostFragment, keyFilePath))
+		for keyName, keyFilePath := range keyFilePaths {
+			hostFragments = append(hostFragments, fmt.Sprintf(singleKeyHostFragment, identity(keyName, keyFilePath)))
 		}
 	}
 
 	return []byte(strings.Join(hostFragments, "\n")), nil
 }
+
+// sshPrivateKey is the parsed private key of the git ssh secret
+type sshPrivateKey struct {
+	signer ssh.Signer
+	// pem is the unencrypted key which is written to ssh dir
+	pem []byte
+}
+
+// parsePrivateKey parses private key of the git ssh secret so that misconfigured keys
+// fail with the key name. passphrase protected keys are decrypted in-process
+// as ssh can not prompt for passphrase during kustomize build
+func parsePrivateKey(name string, data, passphrase []byte) (sshPrivateKey, error) {
+	var key sshPrivateKey
+
+	// if the file containing the SSH key does not have a
+	// newline at the end, ssh does not complain about it but
+	// the key will not work properly
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, byte('\n'))
+	}
+
+	if passphrase == nil {
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			var missingErr *ssh.PassphraseMissingError
+			if errors.As(err, &missingErr) {
+				return key, fmt.Errorf("private key is passphrase protected but passphrase is missing: key=%s entry=%s", name, name+sshPassphraseSuffix)
+			}
+			return key, fmt.Errorf("unable to parse private key: key=%s err:%s", name, err)
+		}
+		return sshPrivateKey{signer: signer, pem: data}, nil
+	}
+
+	raw, err := ssh.ParseRawPrivateKeyWithPassphrase(data, bytes.TrimSpace(passphrase))
+	if err != nil {
+		return key, fmt.Errorf("unable to decrypt private key: key=%s err:%s", name, err)
+	}
+	signer, err := ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return key, fmt.Errorf("unable to parse private key: key=%s err:%s", name, err)
+	}
+	block, err := ssh.MarshalPrivateKey(raw, "")
+	if err != nil {
+		return key, fmt.Errorf("unable to encode decrypted private key: key=%s err:%s", name, err)
+	}
+	return sshPrivateKey{signer: signer, pem: pem.EncodeToMemory(block)}, nil
+}
+
+// verifyCertificate verifies that the OpenSSH certificate is for the given key
+func verifyCertificate(name string, data []byte, signer ssh.Signer) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return fmt.Errorf("unable to parse certificate: key=%s entry=%s err:%s", name, name+sshCertSuffix, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("entry is not a certificate: key=%s entry=%s", name, name+sshCertSuffix)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return fmt.Errorf("certificate is not issued for the private key: key=%s entry=%s", name, name+sshCertSuffix)
+	}
+	return nil
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/ssh"
 	v1 "k8s.io/api/core/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
@@ -15,7 +20,8 @@ import (
 
 func Test_updateRepoBaseAddresses(t *testing.T) {
 	type args struct {
-		in []byte
+		in       []byte
+		repoKeys []repoKey
 	}
 	tests := []struct {
 		name       string
@@ -23,6 +29,7 @@ func Test_updateRepoBaseAddresses(t *testing.T) {
 		wantOut    []byte
 		wantKeyMap map[string]string
 		wantErr    bool
+		wantErrMsg string
 	}{
 		{
 			name: "valid",
@@ -175,6 +182,158 @@ resources:
 			wantErr:    false,
 		},
 
+		{
+			name: "keys-from-repo-config",
+			args: args{
+				in: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+  - app/
+
+  - github.com/org/repo1//manifests/lab-foo?ref=master
+  - ssh://github.com/org/repo1//manifests/lab-foo?ref=master
+  - ssh://git@github.com/org/repo2//manifests/lab-zoo?ref=dev
+  - git@github.com:org/repo3.git/somedir
+  # argocd-voodoobox-plugin: key_c
+  - ssh://github.com/org/repo4//manifests/lab-zoo?ref=dev
+  - ssh://gitlab.io/org/repo5//manifests/lab-bar?ref=main
+`),
+				repoKeys: []repoKey{
+					{Repo: "github.com/org/", Key: "key_a"},
+					{Repo: "github.com/org/repo2", Key: "key_b"},
+				},
+			},
+			wantOut: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+  - app/
+
+  - github.com/org/repo1//manifests/lab-foo?ref=master
+  - ssh://key_a_github_com/org/repo1//manifests/lab-foo?ref=master
+  - ssh://git@key_b_github_com/org/repo2//manifests/lab-zoo?ref=dev
+  - git@key_a_github_com:org/repo3.git/somedir
+  # argocd-voodoobox-plugin: key_c
+  - ssh://key_c_github_com/org/repo4//manifests/lab-zoo?ref=dev
+  - ssh://gitlab.io/org/repo5//manifests/lab-bar?ref=main
+`),
+			wantKeyMap: map[string]string{
+				"key_a": "github.com",
+				"key_b": "github.com",
+				"key_c": "github.com",
+			},
+		},
+
+		{
+			name: "key-comment-outside-of-field",
+			args: args{
+				in: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+# argocd-voodoobox-plugin: key_a
+
+# key comment doesn't need to be immediately above
+bases:
+  - "ssh://github.com/org/repo1//manifests/lab-foo?ref=master"
+components:
+  # argocd-voodoobox-plugin: key_b
+  # some other comment
+  - 'git@gitlab.io:org/repo2.git//components/foo'
+  - ssh://github.com/org/repo3//components/bar # argocd-voodoobox-plugin: key_c
+helmCharts:
+  - name: demo
+    # argocd-voodoobox-plugin: key_d
+    repo: ssh://git@github.com/org/charts
+`)},
+			wantErr:    true,
+			wantErrMsg: "line=3 column=1 key=key_a err:no remote base found after key comment",
+		},
+		{
+			name: "components-bases-helm-charts",
+			args: args{
+				in: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+bases:
+  # argocd-voodoobox-plugin: key_a
+
+  - "ssh://github.com/org/repo1//manifests/lab-foo?ref=master"
+components:
+  # argocd-voodoobox-plugin: key_b
+  # some other comment
+  - 'git@gitlab.io:org/repo2.git//components/foo'
+  - ssh://github.com/org/repo3//components/bar # argocd-voodoobox-plugin: key_c
+helmCharts:
+  - name: demo
+    # argocd-voodoobox-plugin: key_d
+    repo: ssh://git@github.com/org/charts
+`)},
+			wantOut: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+bases:
+  # argocd-voodoobox-plugin: key_a
+
+  - "ssh://key_a_github_com/org/repo1//manifests/lab-foo?ref=master"
+components:
+  # argocd-voodoobox-plugin: key_b
+  # some other comment
+  - 'git@key_b_gitlab_io:org/repo2.git//components/foo'
+  - ssh://key_c_github_com/org/repo3//components/bar # argocd-voodoobox-plugin: key_c
+helmCharts:
+  - name: demo
+    # argocd-voodoobox-plugin: key_d
+    repo: ssh://git@key_d_github_com/org/charts
+`),
+			wantKeyMap: map[string]string{
+				"key_a": "github.com",
+				"key_b": "gitlab.io",
+				"key_c": "github.com",
+				"key_d": "github.com",
+			},
+		},
+		{
+			name: "flow-list",
+			args: args{
+				in: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources: [app/, "ssh://github.com/org/repo1//manifests?ref=main", git@github.com:org/repo2.git//manifests]
+`),
+				repoKeys: []repoKey{{Repo: "github.com/org/", Key: "key_a"}},
+			},
+			wantOut: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources: [app/, "ssh://key_a_github_com/org/repo1//manifests?ref=main", git@key_a_github_com:org/repo2.git//manifests]
+`),
+			wantKeyMap: map[string]string{"key_a": "github.com"},
+		},
+		{
+			name: "key-comment-in-value",
+			args: args{
+				in: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+commonAnnotations:
+  note: "# argocd-voodoobox-plugin: key_a"
+resources:
+  - ssh://github.com/org/repo1//manifests?ref=main
+`)},
+			wantOut: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+commonAnnotations:
+  note: "# argocd-voodoobox-plugin: key_a"
+resources:
+  - ssh://github.com/org/repo1//manifests?ref=main
+`),
+			wantKeyMap: map[string]string{},
+		},
+		{
+			name: "duplicate-key-comment",
+			args: args{
+				in: []byte(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+  # argocd-voodoobox-plugin: key_a
+  - ssh://github.com/org/repo1//manifests?ref=main # argocd-voodoobox-plugin: key_b
+`)},
+			wantErr:    true,
+			wantErrMsg: "line=5 column=52 key=key_b err:remote base already has key comment: key=key_a",
+		},
 		{
 			name: "missing ssh protocol",
 			args: args{
@@ -190,15 +349,19 @@ resources:
 			wantOut:    nil,
 			wantKeyMap: nil,
 			wantErr:    true,
+			wantErrMsg: "line=7 column=3 key=key_c err:remote base is not a valid SSH URL",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotKeyMap, gotOut, err := updateRepoBaseAddresses(bytes.NewReader(tt.args.in))
+			gotKeyMap, gotOut, err := updateRepoBaseAddresses(bytes.NewReader(tt.args.in), tt.args.repoKeys)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("updateRepoBaseAddresses() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErrMsg) {
+				t.Errorf("updateRepoBaseAddresses() error = %v, want %s", err, tt.wantErrMsg)
+			}
 			if diff := cmp.Diff(tt.wantKeyMap, gotKeyMap); diff != "" {
 				t.Errorf("updateRepoBaseAddresses() keyMap mismatch (-want +got):\n%s", diff)
 			}
@@ -282,9 +445,11 @@ func Test_replaceDomainWithConfigHostName(t *testing.T) {
 
 func Test_constructSSHConfig(t *testing.T) {
 	type args struct {
-		keyFilePaths map[string]string
-		keyedDomain  map[string]string
-		globalKey    string
+		keyFilePaths  map[string]string
+		certFilePaths map[string]string
+		keyedDomain   map[string]string
+		repoMap       []repoMapEntry
+		globalKey     string
 	}
 	tests := []struct {
 		name    string
@@ -480,6 +645,79 @@ func Test_constructSSHConfig(t *testing.T) {
     User git`},
 			false,
 		},
+		{"key-with-certificate",
+			args{
+				keyFilePaths: map[string]string{
+					"key_a":   "path/to/this/key/key_a",
+					"sshKeyB": "path/to/this/key/sshKeyB",
+				},
+				certFilePaths: map[string]string{
+					"key_a": "path/to/this/key/key_a-cert.pub",
+				},
+				keyedDomain: map[string]string{
+					"key_a":   "github.com",
+					"sshKeyB": "gitlab.io",
+				},
+			},
+			[]string{`Host key_a_github_com
+    HostName github.com
+    IdentitiesOnly yes
+    IdentityFile path/to/this/key/key_a
+    CertificateFile path/to/this/key/key_a-cert.pub
+    User git
+`, `Host sshKeyB_gitlab_io
+    HostName gitlab.io
+    IdentitiesOnly yes
+    IdentityFile path/to/this/key/sshKeyB
+    User git
+`},
+			false,
+		},
+		{"repo-map",
+			args{
+				keyFilePaths: map[string]string{
+					"key_a":   "path/to/this/key/key_a",
+					"sshKeyB": "path/to/this/key/sshKeyB",
+				},
+				keyedDomain: map[string]string{
+					"key_a": "github.com",
+				},
+				repoMap: []repoMapEntry{
+					{host: "github.com", path: "org/repo1", key: "key_a"},
+					{host: "github.com", path: "org/*-infra", key: "sshKeyB"},
+					{host: "gitlab.io", key: "sshKeyB"},
+				},
+			},
+			[]string{`Host key_a_github_com
+    HostName github.com
+    IdentitiesOnly yes
+    IdentityFile path/to/this/key/key_a
+    User git
+`, `Host sshKeyB_github_com
+    HostName github.com
+    IdentitiesOnly yes
+    IdentityFile path/to/this/key/sshKeyB
+    User git
+`, `Host sshKeyB_gitlab_io
+    HostName gitlab.io
+    IdentitiesOnly yes
+    IdentityFile path/to/this/key/sshKeyB
+    User git
+`},
+			false,
+		},
+		{"missing-repo-map-key-from-secret",
+			args{
+				keyFilePaths: map[string]string{
+					"key_a": "path/to/this/key/key_a",
+				},
+				repoMap: []repoMapEntry{
+					{host: "github.com", path: "org/repo1", key: "keyD"},
+				},
+			},
+			nil,
+			true,
+		},
 		{"missing-referenced-key-from-secret",
 			args{
 				keyFilePaths: map[string]string{
@@ -500,7 +738,7 @@ func Test_constructSSHConfig(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := constructSSHConfig(tt.args.keyFilePaths, tt.args.keyedDomain, tt.args.globalKey)
+			got, err := constructSSHConfig(tt.args.keyFilePaths, tt.args.certFilePaths, tt.args.keyedDomain, tt.args.repoMap, tt.args.globalKey)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("constructSSHConfig() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -521,6 +759,7 @@ func Test_constructSSHConfig(t *testing.T) {
 }
 
 func Test_setupGitSSH(t *testing.T) {
+	_, key := generateSSHKey(t)
 	kubeClient = fake.NewSimpleClientset(
 		&v1.Secret{
 			ObjectMeta: metaV1.ObjectMeta{
@@ -528,11 +767,11 @@ func Test_setupGitSSH(t *testing.T) {
 				Namespace: "foo",
 			},
 			Data: map[string][]byte{
-				"key_a":       []byte("private-key-data"),
-				"sshKeyB":     []byte("private-key-data"),
-				"key_c":       []byte("private-key-data"),
-				"keyD":        []byte("private-key-data"),
-				"keyE":        []byte("private-key-data"),
+				"key_a":       key,
+				"sshKeyB":     key,
+				"key_c":       key,
+				"keyD":        key,
+				"keyE":        key,
 				"known_hosts": []byte("known-host-data"),
 			},
 		},
@@ -576,7 +815,7 @@ func Test_setupGitSSH(t *testing.T) {
 		},
 	}
 
-	wnatEnv = "GIT_SSH_COMMAND=ssh -q -F testData/app-with-remote-base-test1/.ssh/config -o UserKnownHostsFile=path/to/global/known_hosts -o UserKnownHostsFile=testData/app-with-remote-base-test1/.ssh/known_hosts"
+	wnatEnv = "GIT_SSH_COMMAND=ssh -q -F testData/app-with-remote-base-test1/.ssh/config -o 'UserKnownHostsFile=path/to/global/known_hosts testData/app-with-remote-base-test1/.ssh/known_hosts'"
 	env, err = setupGitSSH(context.Background(), withRemoteBaseTestDir, "path/to/global/key", "path/to/global/known_hosts", app)
 	if err != nil {
 		t.Fatal(err)
@@ -630,3 +869,185 @@ func Test_setupGitSSH(t *testing.T) {
 		t.Error("github.com domain should be replaced by keyE_github_com")
 	}
 }
+
+// generateSSHKey returns signer and PEM encoded OpenSSH private key
+func generateSSHKey(t *testing.T) (ssh.Signer, []byte) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(block)
+}
+
+// generateSSHCertificate returns OpenSSH certificate of the public key signed by the given CA
+func generateSSHCertificate(t *testing.T, ca ssh.Signer, pub ssh.PublicKey) []byte {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           "argocd-voodoobox",
+		ValidPrincipals: []string{"git"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return ssh.MarshalAuthorizedKey(cert)
+}
+
+func Test_parsePrivateKey(t *testing.T) {
+	signer, key := generateSSHKey(t)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedKey := pem.EncodeToMemory(block)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase []byte
+		wantErrMsg string
+	}{
+		{"valid-key", key, nil, ""},
+		{"missing-trailing-newline", bytes.TrimSpace(key), nil, ""},
+		{"invalid-key", []byte("private-key-data"), nil, "unable to parse private key: key=key_a err:ssh: no key found"},
+		{"passphrase-protected", encryptedKey, []byte("secret\n"), ""},
+		{"missing-passphrase", encryptedKey, nil, "private key is passphrase protected but passphrase is missing: key=key_a entry=key_a.passphrase"},
+		{"wrong-passphrase", encryptedKey, []byte("wrong"), "unable to decrypt private key: key=key_a err:x509: decryption password incorrect"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePrivateKey("key_a", tt.data, tt.passphrase)
+			if tt.wantErrMsg != "" {
+				if err == nil || err.Error() != tt.wantErrMsg {
+					t.Fatalf("parsePrivateKey() error = %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePrivateKey() unexpected error = %v", err)
+			}
+			// written key must be usable by ssh without passphrase
+			parsed, err := ssh.ParsePrivateKey(got.pem)
+			if err != nil {
+				t.Fatalf("unable to parse written key err:%s", err)
+			}
+			if !bytes.Equal(parsed.PublicKey().Marshal(), got.signer.PublicKey().Marshal()) {
+				t.Error("written key doesn't match parsed key")
+			}
+			if tt.name == "valid-key" && !bytes.Equal(got.signer.PublicKey().Marshal(), signer.PublicKey().Marshal()) {
+				t.Error("parsed key doesn't match generated key")
+			}
+		})
+	}
+}
+
+func Test_verifyCertificate(t *testing.T) {
+	ca, _ := generateSSHKey(t)
+	signer, _ := generateSSHKey(t)
+	other, _ := generateSSHKey(t)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantErrMsg string
+	}{
+		{"valid-certificate", generateSSHCertificate(t, ca, signer.PublicKey()), ""},
+		{"certificate-of-other-key", generateSSHCertificate(t, ca, other.PublicKey()), "certificate is not issued for the private key: key=key_a entry=key_a-cert.pub"},
+		{"public-key", ssh.MarshalAuthorizedKey(signer.PublicKey()), "entry is not a certificate: key=key_a entry=key_a-cert.pub"},
+		{"invalid-data", []byte("cert-data"), "unable to parse certificate: key=key_a entry=key_a-cert.pub err:ssh: no key found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyCertificate("key_a", tt.data, signer)
+			if tt.wantErrMsg == "" {
+				if err != nil {
+					t.Fatalf("verifyCertificate() unexpected error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErrMsg {
+				t.Fatalf("verifyCertificate() error = %v, want %s", err, tt.wantErrMsg)
+			}
+		})
+	}
+}
+
+func Test_setupGitSSHCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca, _ := generateSSHKey(t)
+	signer, key := generateSSHKey(t)
+
+	tests := []struct {
+		name       string
+		data       map[string][]byte
+		wantErrMsg string
+	}{
+		{"with-certificate", map[string][]byte{
+			"key_a":          key,
+			"key_a-cert.pub": generateSSHCertificate(t, ca, signer.PublicKey()),
+		}, ""},
+		{"invalid-key", map[string][]byte{
+			"key_a": key,
+			"key_b": []byte("private-key-data"),
+		}, "unable to parse private key: key=key_b err:ssh: no key found"},
+		{"certificate-without-key", map[string][]byte{
+			"key_a":          key,
+			"key_b-cert.pub": generateSSHCertificate(t, ca, signer.PublicKey()),
+		}, "private key is missing from git ssh secret: key=key_b entry=key_b-cert.pub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeClient = fake.NewSimpleClientset(
+				&v1.Secret{
+					ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-ssh", Namespace: "foo"},
+					Data:       tt.data,
+				},
+			)
+			cwd := filepath.Join(dir, tt.name)
+			if err := os.Mkdir(cwd, 0700); err != nil {
+				t.Fatal(err)
+			}
+			app := applicationInfo{
+				name:                 "app-foo",
+				destinationNamespace: "foo",
+				gitSSHSecret:         secretInfo{name: "argocd-voodoobox-git-ssh"},
+			}
+
+			_, err := setupGitSSH(context.Background(), cwd, "", "", app)
+			if tt.wantErrMsg != "" {
+				if err == nil || err.Error() != tt.wantErrMsg {
+					t.Fatalf("setupGitSSH() error = %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := os.ReadFile(filepath.Join(cwd, ".ssh", "config"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "    IdentityFile " + filepath.Join(cwd, ".ssh", "key_a") + "\n    CertificateFile " + filepath.Join(cwd, ".ssh", "key_a-cert.pub") + "\n"
+			if !strings.Contains(string(config), want) {
+				t.Errorf("ssh config is missing certificate\n%s", config)
+			}
+		})
+	}
+}
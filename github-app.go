@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// following keys of git https secret are used for GitHub App credentials
+const (
+	githubAppIDKey             = "github-app-id"
+	githubAppInstallationIDKey = "github-app-installation-id"
+	githubAppPrivateKeyKey     = "github-app-private-key"
+	// optional keys for GitHub Enterprise Server
+	githubAppAPIURLKey = "github-app-api-url"
+	githubAppHostKey   = "github-app-host"
+
+	githubAPIURL = "https://api.github.com"
+	githubHost   = "github.com"
+
+	// githubAppTokenExpiryMargin is the min remaining validity of the cached token,
+	// it should be long enough for the build to fetch all remote bases
+	githubAppTokenExpiryMargin = 10 * time.Minute
+)
+
+var (
+	// githubAppTokenCacheDir is the dir where installation tokens are cached until expiry
+	githubAppTokenCacheDir string
+
+	githubHTTPClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// githubApp holds GitHub App credentials used to mint installation tokens
+type githubApp struct {
+	appID          string
+	installationID string
+	privateKey     *rsa.PrivateKey
+	apiURL         string
+	host           string
+	// cacheKey is the hash of all the credentials, so that cached
+	// token can only be found by the apps which have access to credentials
+	cacheKey string
+}
+
+// installationToken is the response of GitHub `access_tokens` endpoint
+// it is also the format of the cached token file
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// parseGitHubApp returns GitHub App from git https secret data or nil if app is not configured
+func parseGitHubApp(data map[string][]byte) (*githubApp, error) {
+	if len(data[githubAppIDKey]) == 0 && len(data[githubAppInstallationIDKey]) == 0 && len(data[githubAppPrivateKeyKey]) == 0 {
+		return nil, nil
+	}
+	for _, k := range []string{githubAppIDKey, githubAppInstallationIDKey, githubAppPrivateKeyKey} {
+		if len(trimmedValue(data[k])) == 0 {
+			return nil, fmt.Errorf("github app key is required: key=%s", k)
+		}
+	}
+
+	privateKey, err := parseRSAPrivateKey(data[githubAppPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse github app private key err:%s", err)
+	}
+
+	app := &githubApp{
+		appID:          trimmedValue(data[githubAppIDKey]),
+		installationID: trimmedValue(data[githubAppInstallationIDKey]),
+		privateKey:     privateKey,
+		apiURL:         strings.TrimSuffix(trimmedValue(data[githubAppAPIURLKey]), "/"),
+		host:           trimmedValue(data[githubAppHostKey]),
+	}
+	if app.apiURL == "" {
+		app.apiURL = githubAPIURL
+	}
+	if app.host == "" {
+		app.host = githubHost
+	}
+
+	h := sha256.New()
+	for _, v := range []string{app.apiURL, app.appID, app.installationID, string(data[githubAppPrivateKeyKey])} {
+		h.Write([]byte(v + "\n"))
+	}
+	app.cacheKey = hex.EncodeToString(h.Sum(nil))
+
+	return app, nil
+}
+
+func trimmedValue(v []byte) string {
+	return strings.TrimSpace(string(v))
+}
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not RSA key")
+	}
+	return rsaKey, nil
+}
+
+// token returns cached installation token if its still valid otherwise mints new token
+func (a *githubApp) token(ctx context.Context, now time.Time) (string, error) {
+	cacheFile := filepath.Join(githubAppTokenCacheDir, a.cacheKey)
+
+	if data, err := os.ReadFile(cacheFile); err == nil {
+		var t installationToken
+		if err := json.Unmarshal(data, &t); err == nil && t.ExpiresAt.After(now.Add(githubAppTokenExpiryMargin)) {
+			return t.Token, nil
+		}
+	}
+
+	t, err := a.mintToken(ctx, now)
+	if err != nil {
+		return "", err
+	}
+	logger.Info("minted github app installation token", "app-id", a.appID, "installation-id", a.installationID, "expires-at", t.ExpiresAt)
+
+	if err := writeTokenCache(cacheFile, t); err != nil {
+		// token can still be used for current build
+		logger.Warn("unable to cache github app installation token", "err", err)
+	}
+	return t.Token, nil
+}
+
+func (a *githubApp) mintToken(ctx context.Context, now time.Time) (installationToken, error) {
+	var t installationToken
+
+	jwt, err := a.jwt(now)
+	if err != nil {
+		return t, fmt.Errorf("unable to create github app jwt err:%s", err)
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", a.apiURL, a.installationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return t, err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := githubHTTPClient.Do(req)
+	if err != nil {
+		return t, fmt.Errorf("unable to mint github app installation token: app-id=%s installation-id=%s err:%s", a.appID, a.installationID, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return t, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return t, fmt.Errorf("unable to mint github app installation token: app-id=%s installation-id=%s status=%d body=%s",
+			a.appID, a.installationID, resp.StatusCode, body)
+	}
+	if err := json.Unmarshal(body, &t); err != nil {
+		return t, fmt.Errorf("unable to decode github app installation token err:%s", err)
+	}
+	if t.Token == "" {
+		return t, errors.New("github app installation token is empty")
+	}
+	return t, nil
+}
+
+// jwt returns RS256 signed JWT used to authenticate as GitHub App.
+// iat is set in the past to allow for clock drift and exp is within 10 min limit
+func (a *githubApp) jwt(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.privateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// writeTokenCache writes token to a temp file and renames it so that
+// concurrent builds never read partially written file
+func writeTokenCache(cacheFile string, t installationToken) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(cacheFile), ".token-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), cacheFile)
+}
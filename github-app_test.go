@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newGitHubTokenServer is a stand-in for GitHub access_tokens endpoint, it verifies
+// JWT signed by given key and returns given token valid for given duration
+func newGitHubTokenServer(t *testing.T, key *rsa.PrivateKey, token string, validFor time.Duration) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	calls := &atomic.Int32{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/456/access_tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			http.Error(w, "invalid jwt", http.StatusUnauthorized)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], sig); err != nil {
+			http.Error(w, "invalid jwt signature", http.StatusUnauthorized)
+			return
+		}
+		var claims struct {
+			Iss string `json:"iss"`
+			Exp int64  `json:"exp"`
+		}
+		data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if err := json.Unmarshal(data, &claims); err != nil || claims.Iss != "123" || claims.Exp < time.Now().Unix() {
+			http.Error(w, "invalid jwt claims", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(installationToken{Token: token, ExpiresAt: time.Now().Add(validFor)})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, calls
+}
+
+func generateRSAKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func Test_githubAppToken(t *testing.T) {
+	key, keyPEM := generateRSAKey(t)
+
+	t.Run("cached-until-expiry", func(t *testing.T) {
+		githubAppTokenCacheDir = t.TempDir()
+		srv, calls := newGitHubTokenServer(t, key, "ghs_token", time.Hour)
+
+		app, err := parseGitHubApp(map[string][]byte{
+			githubAppIDKey:             []byte("123"),
+			githubAppInstallationIDKey: []byte("456"),
+			githubAppPrivateKeyKey:     keyPEM,
+			githubAppAPIURLKey:         []byte(srv.URL + "/"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for range 2 {
+			got, err := app.token(context.Background(), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "ghs_token" {
+				t.Errorf("token() got:%s want:ghs_token", got)
+			}
+		}
+		if calls.Load() != 1 {
+			t.Errorf("token should be minted once and then cached got calls:%d", calls.Load())
+		}
+
+		// token is about to expire
+		if _, err := app.token(context.Background(), time.Now().Add(55*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if calls.Load() != 2 {
+			t.Errorf("token should be minted again once cached token expires got calls:%d", calls.Load())
+		}
+	})
+
+	t.Run("wrong-key", func(t *testing.T) {
+		githubAppTokenCacheDir = t.TempDir()
+		_, otherKeyPEM := generateRSAKey(t)
+		srv, _ := newGitHubTokenServer(t, key, "ghs_token", time.Hour)
+
+		app, err := parseGitHubApp(map[string][]byte{
+			githubAppIDKey:             []byte("123"),
+			githubAppInstallationIDKey: []byte("456"),
+			githubAppPrivateKeyKey:     otherKeyPEM,
+			githubAppAPIURLKey:         []byte(srv.URL),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := app.token(context.Background(), time.Now()); err == nil || !strings.Contains(err.Error(), "status=401") {
+			t.Errorf("token() should fail with invalid jwt got:%v", err)
+		}
+	})
+
+	t.Run("missing-keys", func(t *testing.T) {
+		if _, err := parseGitHubApp(map[string][]byte{githubAppIDKey: []byte("123")}); err == nil {
+			t.Error("parseGitHubApp() should fail if installation id and private key are missing")
+		}
+		app, err := parseGitHubApp(map[string][]byte{"github.com": []byte("token")})
+		if err != nil || app != nil {
+			t.Errorf("parseGitHubApp() should return nil app if not configured got:%v err:%v", app, err)
+		}
+	})
+}
+
+func Test_githubAppRemoteBase(t *testing.T) {
+	githubAppTokenCacheDir = t.TempDir()
+	key, keyPEM := generateRSAKey(t)
+	tokenSrv, _ := newGitHubTokenServer(t, key, "ghs_installation_token", time.Hour)
+
+	root := t.TempDir()
+	newBareRepo(t, root)
+	gitSrv := newGitHTTPServer(t, root, gitHTTPSDefaultUsername, "ghs_installation_token")
+	// test server uses self signed certificate
+	t.Setenv("GIT_SSL_NO_VERIFY", "true")
+
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-https", Namespace: "foo"},
+			Data: map[string][]byte{
+				githubAppIDKey:             []byte("123"),
+				githubAppInstallationIDKey: []byte("456"),
+				githubAppPrivateKeyKey:     keyPEM,
+				githubAppAPIURLKey:         []byte(tokenSrv.URL),
+				githubAppHostKey:           []byte(strings.TrimPrefix(gitSrv.URL, "https://")),
+			},
+		},
+	)
+
+	dir := t.TempDir()
+	k := "resources:\n  - " + gitSrv.URL + "/repo.git//base?ref=main\n"
+	if err := os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(k), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := applicationInfo{name: "foo", destinationNamespace: "foo", gitHTTPSSecret: secretInfo{name: "argocd-voodoobox-git-https"}}
+	got, err := ensureBuild(context.Background(), dir, "", "", app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "name: remote-base") {
+		t.Errorf("remote base resources missing from output\n%s", got)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+const (
+	helmRepositoriesKey = "repositories.yaml"
+	// helmCredentialsEnv is set for kustomize build so that helm wrapper
+	// can find credentials file of private chart repositories
+	helmCredentialsEnv = "AVP_HELM_CREDENTIALS_FILE"
+
+	// helmCredentialsRepoName is the name private chart repository is added with to pull charts
+	helmCredentialsRepoName = "voodoobox-private"
+
+	helmWrapperFragment = `#!/bin/sh
+exec '%s' helm-wrapper "$@"
+`
+)
+
+// helmPullValueFlags are the `helm pull` flags used by kustomize which take value
+var helmPullValueFlags = []string{"--untardir", "--version", "-d", "--destination"}
+
+// helmRepositories is the format of `repositories.yaml` key of helm secret
+// it follows the format of helm's own repositories file
+type helmRepositories struct {
+	Repositories []helmRepository `json:"repositories"`
+}
+
+type helmRepository struct {
+	Name     string `json:"name,omitempty"`
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// setupHelm returns helm command to be used by kustomize and env required by it.
+// if helm secret with private chart repositories credentials is found, then command is a
+// wrapper script which will run plugin's `helm-wrapper` command to add credentials to `helm pull`
+func setupHelm(ctx context.Context, cwd string, app applicationInfo) (string, []string, error) {
+	if app.helmSecret.name == "" {
+		return "helm", nil, nil
+	}
+
+	sec, err := secret(ctx, app, app.helmSecret)
+	if err != nil {
+		// helm secret is optional as public charts do not need credentials
+		if errors.Is(err, errNotFound) {
+			return "helm", nil, nil
+		}
+		return "", nil, err
+	}
+
+	repos, err := parseHelmRepositories(sec.Data[helmRepositoriesKey])
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to parse helm repositories: secret=%s err:%s", app.helmSecret.name, err)
+	}
+	if len(repos) == 0 {
+		return "helm", nil, nil
+	}
+
+	helmDir := filepath.Join(cwd, ".helm")
+	if err := os.Mkdir(helmDir, 0700); err != nil {
+		return "", nil, fmt.Errorf("unable to create helm config dir err:%s", err)
+	}
+
+	credsFile := filepath.Join(helmDir, helmRepositoriesKey)
+	if err := os.WriteFile(credsFile, sec.Data[helmRepositoriesKey], 0600); err != nil {
+		return "", nil, fmt.Errorf("unable to write helm repositories file err:%s", err)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to get plugin executable path err:%s", err)
+	}
+	wrapper := filepath.Join(helmDir, "helm")
+	if err := os.WriteFile(wrapper, fmt.Appendf(nil, helmWrapperFragment, self), 0700); err != nil {
+		return "", nil, fmt.Errorf("unable to write helm wrapper err:%s", err)
+	}
+
+	return wrapper, []string{fmt.Sprintf("%s=%s", helmCredentialsEnv, credsFile)}, nil
+}
+
+func parseHelmRepositories(data []byte) ([]helmRepository, error) {
+	var repos helmRepositories
+	if err := yaml.Unmarshal(data, &repos); err != nil {
+		return nil, err
+	}
+	for _, r := range repos.Repositories {
+		if r.URL == "" {
+			return nil, fmt.Errorf("repository url is required: name=%s", r.Name)
+		}
+	}
+	return repos.Repositories, nil
+}
+
+// runHelmWrapper runs helm with given args, adding credentials of
+// matching private chart repository to `helm pull` command
+func runHelmWrapper(args []string) error {
+	var repos []helmRepository
+	var configDir string
+	if credsFile := os.Getenv(helmCredentialsEnv); credsFile != "" {
+		data, err := os.ReadFile(credsFile)
+		if err != nil {
+			return fmt.Errorf("unable to read helm repositories file err:%s", err)
+		}
+		if repos, err = parseHelmRepositories(data); err != nil {
+			return fmt.Errorf("unable to parse helm repositories file err:%s", err)
+		}
+		configDir = filepath.Dir(credsFile)
+	}
+
+	cmds, err := helmCommandsWithCredentials(args, repos, configDir)
+	if err != nil {
+		return err
+	}
+	for _, c := range cmds {
+		h := exec.Command("helm", c.args...)
+		h.Stdin = os.Stdin
+		if c.stdin != "" {
+			h.Stdin = strings.NewReader(c.stdin)
+		}
+		h.Stdout = os.Stdout
+		h.Stderr = os.Stderr
+		if err := h.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// helmCommand is the helm command run by the wrapper
+type helmCommand struct {
+	args []string
+	// stdin is used instead of wrapper's stdin if set
+	stdin string
+}
+
+// helmCommandsWithCredentials returns helm commands to run given args with credentials of the
+// repository matching chart repo of `helm pull` command. longest matching URL prefix is used.
+// credentials are never passed as args since args are visible to all processes, for OCI
+// registries registry config file is written to configDir and chart repositories are added to
+// repository config in configDir with `--password-stdin` so chart is pulled by repository name.
+func helmCommandsWithCredentials(args []string, repos []helmRepository, configDir string) ([]helmCommand, error) {
+	cmds := []helmCommand{{args: args}}
+	if len(args) == 0 || args[0] != "pull" {
+		return cmds, nil
+	}
+
+	var repoURL string
+	// repoArgs are indexes of `--repo` flag which is replaced by repository name
+	var repoArgs []int
+	chartArg := -1
+	for i := 1; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--repo" && i+1 < len(args):
+			repoURL, repoArgs = args[i+1], []int{i, i + 1}
+			i++
+		case strings.HasPrefix(a, "--repo="):
+			repoURL, repoArgs = strings.TrimPrefix(a, "--repo="), []int{i}
+		case slices.Contains(helmPullValueFlags, a):
+			i++
+		case strings.HasPrefix(a, "oci://"):
+			repoURL, chartArg = a, i
+		case !strings.HasPrefix(a, "-") && chartArg == -1:
+			chartArg = i
+		}
+	}
+	if repoURL == "" {
+		return cmds, nil
+	}
+
+	var match *helmRepository
+	for i, r := range repos {
+		if strings.HasPrefix(repoURL, strings.TrimSuffix(r.URL, "/")) &&
+			(match == nil || len(r.URL) > len(match.URL)) {
+			match = &repos[i]
+		}
+	}
+	if match == nil {
+		return cmds, nil
+	}
+
+	if strings.HasPrefix(repoURL, "oci://") {
+		host, _, _ := strings.Cut(strings.TrimPrefix(repoURL, "oci://"), "/")
+		auth := base64.StdEncoding.EncodeToString([]byte(match.Username + ":" + match.Password))
+		registryConfig := filepath.Join(configDir, "registry-config.json")
+		data := fmt.Sprintf(`{"auths":{%q:{"auth":%q}}}`, host, auth)
+		if err := os.WriteFile(registryConfig, []byte(data), 0600); err != nil {
+			return nil, fmt.Errorf("unable to write helm registry config err:%s", err)
+		}
+		return []helmCommand{{args: append(slices.Clone(args), "--registry-config", registryConfig)}}, nil
+	}
+
+	if chartArg == -1 {
+		return nil, fmt.Errorf("unable to find chart name of helm pull command: args=%s", strings.Join(args, " "))
+	}
+	configArgs := []string{
+		"--repository-config", filepath.Join(configDir, "repository-config.yaml"),
+		"--repository-cache", filepath.Join(configDir, "repository-cache"),
+	}
+	add := append([]string{"repo", "add", helmCredentialsRepoName, repoURL, "--force-update",
+		"--username", match.Username, "--password-stdin"}, configArgs...)
+
+	var pull []string
+	for i, a := range args {
+		switch {
+		case slices.Contains(repoArgs, i):
+			continue
+		case i == chartArg:
+			a = helmCredentialsRepoName + "/" + a
+		}
+		pull = append(pull, a)
+	}
+	return []helmCommand{
+		{args: add, stdin: match.Password},
+		{args: append(pull, configArgs...)},
+	}, nil
+}
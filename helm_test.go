@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeHelm mimics helm commands used by kustomize, `template` prints a Secret
+// containing values file passed to it so that tests can verify rendered values
+const fakeHelm = `#!/bin/sh
+case "$1" in
+version)
+  echo "v3.16.4+g7877b45"
+  ;;
+template)
+  while [ $# -gt 0 ]; do
+    if [ "$1" = "-f" ] || [ "$1" = "--values" ]; then values="$2"; fi
+    shift
+  done
+  echo "apiVersion: v1"
+  echo "kind: Secret"
+  echo "metadata:"
+  echo "  name: demo"
+  echo "stringData:"
+  echo "  values.yaml: |"
+  sed 's/^/    /' "$values"
+  ;;
+*)
+  echo "unexpected helm command $@" >&2
+  exit 1
+  ;;
+esac
+`
+
+func Test_helmChartInflation(t *testing.T) {
+	helmDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(helmDir, "helm"), []byte(fakeHelm), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", helmDir+":"+os.Getenv("PATH"))
+
+	dir := filepath.Join(t.TempDir(), "app")
+	if out, err := exec.Command("cp", "-r", "./testData/app-with-helm", dir).CombinedOutput(); err != nil {
+		t.Fatalf("%s", out)
+	}
+
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-strongbox-keyring", Namespace: "foo"},
+			Data: map[string][]byte{
+				strongboxKeyringFilename: getFileContent(t, "./testData/app-with-secrets/.keyRing"),
+			},
+		},
+	)
+	app := applicationInfo{
+		name:                 "foo",
+		destinationNamespace: "foo",
+		keyringSecrets:       []secretInfo{{name: "argocd-voodoobox-strongbox-keyring"}},
+		helmEnabled:          true,
+		helmSecret:           secretInfo{name: "argocd-voodoobox-helm"},
+	}
+
+	if _, err := ensureDecryption(context.Background(), dir, app); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ensureBuild(context.Background(), dir, "", "", app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "password: PlainText") {
+		t.Errorf("decrypted values file should be passed to helm got:\n%s", got)
+	}
+
+	// without helm enabled kustomize should fail on helmCharts
+	dir2 := filepath.Join(t.TempDir(), "app")
+	if out, err := exec.Command("cp", "-r", "./testData/app-with-helm", dir2).CombinedOutput(); err != nil {
+		t.Fatalf("%s", out)
+	}
+	app.helmEnabled = false
+	if _, err := ensureBuild(context.Background(), dir2, "", "", app); err == nil {
+		t.Error("build should fail when helm is not enabled")
+	}
+}
+
+func Test_setupHelm(t *testing.T) {
+	repos := []byte(`repositories:
+  - name: private
+    url: https://charts.example.com
+    username: user
+    password: token
+`)
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-helm", Namespace: "foo"},
+			Data:       map[string][]byte{helmRepositoriesKey: repos},
+		},
+	)
+
+	t.Run("without-secret", func(t *testing.T) {
+		app := applicationInfo{destinationNamespace: "bar", helmEnabled: true, helmSecret: secretInfo{name: "argocd-voodoobox-helm"}}
+		cmd, env, err := setupHelm(context.Background(), t.TempDir(), app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd != "helm" || env != nil {
+			t.Errorf("setupHelm() should use plain helm got cmd=%s env=%v", cmd, env)
+		}
+	})
+
+	t.Run("with-secret", func(t *testing.T) {
+		dir := t.TempDir()
+		app := applicationInfo{destinationNamespace: "foo", helmEnabled: true, helmSecret: secretInfo{name: "argocd-voodoobox-helm"}}
+		cmd, env, err := setupHelm(context.Background(), dir, app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(dir, ".helm", "helm"); cmd != want {
+			t.Errorf("setupHelm() cmd=%s want=%s", cmd, want)
+		}
+		wantEnv := []string{helmCredentialsEnv + "=" + filepath.Join(dir, ".helm", helmRepositoriesKey)}
+		if diff := cmp.Diff(wantEnv, env); diff != "" {
+			t.Errorf("setupHelm() env mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(string(repos), string(getFileContent(t, filepath.Join(dir, ".helm", helmRepositoriesKey)))); diff != "" {
+			t.Errorf("setupHelm() repositories file mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func Test_helmCommandsWithCredentials(t *testing.T) {
+	repos := []helmRepository{
+		{URL: "https://charts.example.com", Username: "user", Password: "token"},
+		{URL: "https://charts.example.com/team-a/", Username: "team-a", Password: "token-a"},
+		{URL: "oci://registry.example.com/charts", Username: "oci-user", Password: "oci-token"},
+	}
+	dir := t.TempDir()
+	configArgs := []string{
+		"--repository-config", filepath.Join(dir, "repository-config.yaml"),
+		"--repository-cache", filepath.Join(dir, "repository-cache"),
+	}
+	tests := []struct {
+		name string
+		args []string
+		want []helmCommand
+	}{
+		{
+			"not-pull",
+			[]string{"template", "demo", "charts/demo"},
+			[]helmCommand{{args: []string{"template", "demo", "charts/demo"}}},
+		},
+		{
+			"public-repo",
+			[]string{"pull", "--untar", "--untardir", "charts", "--repo", "https://charts.public.io", "demo"},
+			[]helmCommand{{args: []string{"pull", "--untar", "--untardir", "charts", "--repo", "https://charts.public.io", "demo"}}},
+		},
+		{
+			"private-repo",
+			[]string{"pull", "--untar", "--untardir", "charts", "--repo", "https://charts.example.com", "demo", "--version", "1.0.0"},
+			[]helmCommand{
+				{
+					args:  append([]string{"repo", "add", "voodoobox-private", "https://charts.example.com", "--force-update", "--username", "user", "--password-stdin"}, configArgs...),
+					stdin: "token",
+				},
+				{args: append([]string{"pull", "--untar", "--untardir", "charts", "voodoobox-private/demo", "--version", "1.0.0"}, configArgs...)},
+			},
+		},
+		{
+			"longest-prefix",
+			[]string{"pull", "--repo=https://charts.example.com/team-a", "demo"},
+			[]helmCommand{
+				{
+					args:  append([]string{"repo", "add", "voodoobox-private", "https://charts.example.com/team-a", "--force-update", "--username", "team-a", "--password-stdin"}, configArgs...),
+					stdin: "token-a",
+				},
+				{args: append([]string{"pull", "voodoobox-private/demo"}, configArgs...)},
+			},
+		},
+		{
+			"oci",
+			[]string{"pull", "--untar", "--untardir", "charts", "oci://registry.example.com/charts/demo"},
+			[]helmCommand{{args: []string{"pull", "--untar", "--untardir", "charts", "oci://registry.example.com/charts/demo", "--registry-config", filepath.Join(dir, "registry-config.json")}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := helmCommandsWithCredentials(tt.args, repos, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(helmCommand{})); diff != "" {
+				t.Errorf("helmCommandsWithCredentials() mismatch (-want +got):\n%s", diff)
+			}
+			for _, c := range got {
+				if strings.Contains(strings.Join(c.args, " "), "token") {
+					t.Errorf("password should not be passed as arg got:%s", c.args)
+				}
+			}
+		})
+	}
+
+	wantConfig := `{"auths":{"registry.example.com":{"auth":"b2NpLXVzZXI6b2NpLXRva2Vu"}}}`
+	if got := string(getFileContent(t, filepath.Join(dir, "registry-config.json"))); got != wantConfig {
+		t.Errorf("unexpected registry config got:%s want:%s", got, wantConfig)
+	}
+}
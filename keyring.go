@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/urfave/cli/v2"
+)
+
+// keyringSource holds keyring and identity data read from a keyring secret
+type keyringSource struct {
+	secret       secretInfo
+	keyringData  []byte
+	identityData []byte
+}
+
+// keyringSecrets returns keyring secrets of the app. if list of namespaces is set keyring
+// secret of each of the namespaces is used otherwise only secret of single namespace
+func keyringSecrets(c *cli.Context) []secretInfo {
+	name := c.String("app-strongbox-secret-name")
+
+	var secrets []secretInfo
+	for _, ns := range strings.Split(c.String("app-strongbox-secret-namespaces"), ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			secrets = append(secrets, secretInfo{name: name, namespace: ns, checkExpiry: true})
+		}
+	}
+	if len(secrets) == 0 {
+		secrets = append(secrets, secretInfo{name: name, namespace: c.String("app-strongbox-secret-namespace"), checkExpiry: true})
+	}
+	return secrets
+}
+
+// keyringSecretsData reads keyring and identity data from all the keyring secrets of the
+// app and merges them. missing secrets are skipped, errNotFound is only returned if none
+// of the secrets are found.
+func keyringSecretsData(ctx context.Context, app applicationInfo) ([]byte, []byte, error) {
+	var sources []keyringSource
+	var notFound []string
+	for _, si := range app.keyringSecrets {
+		keyringData, identityData, err := secretData(ctx, app, si)
+		if errors.Is(err, errNotFound) {
+			namespace := si.namespace
+			if namespace == "" {
+				namespace = app.destinationNamespace
+			}
+			logger.Warn("keyring secret not found, its keys are not used", "secretNamespace", namespace, "secretName", si.name)
+			notFound = append(notFound, namespace+"/"+si.name)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		sources = append(sources, keyringSource{secret: si, keyringData: keyringData, identityData: identityData})
+	}
+	if len(sources) == 0 {
+		if len(notFound) == 0 {
+			return nil, nil, fmt.Errorf("keyring secret is not configured: err=%w", errNotFound)
+		}
+		return nil, nil, fmt.Errorf("keyring secret not found: secrets=%s err=%w", strings.Join(notFound, ","), errNotFound)
+	}
+
+	keyringData, err := mergeKeyRings(sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyringData, mergeIdentities(sources), nil
+}
+
+// mergeKeyRings merges legacy keyring entries of all the sources deduped by key-id.
+// it returns error listing all the key-ids which map to different keys in the sources.
+// if only one source has keyring its data is returned as is.
+func mergeKeyRings(sources []keyringSource) ([]byte, error) {
+	var withKeyring []keyringSource
+	for _, s := range sources {
+		if s.keyringData != nil {
+			withKeyring = append(withKeyring, s)
+		}
+	}
+	switch len(withKeyring) {
+	case 0:
+		return nil, nil
+	case 1:
+		return withKeyring[0].keyringData, nil
+	}
+
+	var merged strongboxKeyRing
+	// secret of the first entry of each key-id to report conflicts
+	entrySecret := make(map[string]secretInfo)
+	var conflicts []string
+	for _, s := range withKeyring {
+		var kr strongboxKeyRing
+		if err := yaml.Unmarshal(s.keyringData, &kr); err != nil {
+			return nil, fmt.Errorf("unable to parse keyring: secretNamespace=%s secretName=%s err:%s", s.secret.namespace, s.secret.name, err)
+		}
+		for _, ke := range kr.KeyEntries {
+			i := slices.IndexFunc(merged.KeyEntries, func(e strongboxKeyEntry) bool { return e.KeyID == ke.KeyID })
+			if i == -1 {
+				merged.KeyEntries = append(merged.KeyEntries, ke)
+				entrySecret[ke.KeyID] = s.secret
+				continue
+			}
+			same, err := sameKey(merged.KeyEntries[i].Key, ke.Key)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode key: key-id=%s secretNamespace=%s secretName=%s err:%s", ke.KeyID, s.secret.namespace, s.secret.name, err)
+			}
+			if !same {
+				first := entrySecret[ke.KeyID]
+				conflicts = append(conflicts, fmt.Sprintf("key-id=%s secrets=%s/%s,%s/%s", ke.KeyID, first.namespace, first.name, s.secret.namespace, s.secret.name))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("same key-id maps to different keys in keyring secrets: %s", strings.Join(conflicts, " "))
+	}
+
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write merged keyring err:%s", err)
+	}
+	return data, nil
+}
+
+// sameKey returns true if both base64 encoded keys decode to the same key, whitespace and padding are ignored
+func sameKey(a, b string) (bool, error) {
+	decode := func(k string) ([]byte, error) {
+		k = strings.TrimRight(strings.Join(strings.Fields(k), ""), "=")
+		return base64.RawStdEncoding.DecodeString(k)
+	}
+	keyA, err := decode(a)
+	if err != nil {
+		return false, err
+	}
+	keyB, err := decode(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(keyA, keyB), nil
+}
+
+// mergeIdentities merges age identities of all the sources, identities are deduped so
+// the same identity in multiple secrets is only used once. comments are kept as is.
+// if only one source has identity its data is returned as is.
+func mergeIdentities(sources []keyringSource) []byte {
+	var withIdentity []keyringSource
+	for _, s := range sources {
+		if s.identityData != nil {
+			withIdentity = append(withIdentity, s)
+		}
+	}
+	switch len(withIdentity) {
+	case 0:
+		return nil
+	case 1:
+		return withIdentity[0].identityData
+	}
+
+	var merged bytes.Buffer
+	seen := make(map[string]bool)
+	for _, s := range withIdentity {
+		scanner := bufio.NewScanner(bytes.NewReader(s.identityData))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			if !strings.HasPrefix(line, "#") {
+				if seen[line] {
+					continue
+				}
+				seen[line] = true
+			}
+			merged.WriteString(line + "\n")
+		}
+	}
+	return merged.Bytes()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_mergeKeyRings(t *testing.T) {
+	shared := keyringSource{secret: secretInfo{namespace: "shared", name: "keyring"}, keyringData: []byte(`keyentries:
+- description: shared
+  key-id: id-shared
+  key: c2hhcmVk
+- description: common
+  key-id: id-common
+  key: Y29tbW9u
+- description: padded
+  key-id: id-padded
+  key: cGFkZGVkMQ==
+`)}
+	own := keyringSource{secret: secretInfo{namespace: "foo", name: "keyring"}, keyringData: []byte(`keyentries:
+- description: own
+  key-id: id-own
+  key: b3du
+- description: common copy with whitespace
+  key-id: id-common
+  key: " Y29tbW9u "
+- description: padded copy without padding
+  key-id: id-padded
+  key: cGFkZGVkMQ
+`)}
+	conflicting := keyringSource{secret: secretInfo{namespace: "bar", name: "keyring"}, keyringData: []byte(`keyentries:
+- description: shared
+  key-id: id-shared
+  key: b3RoZXI=
+`)}
+
+	t.Run("single", func(t *testing.T) {
+		got, err := mergeKeyRings([]keyringSource{{secret: own.secret}, own})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(own.keyringData) {
+			t.Errorf("keyring of single secret should be used as is got:%s", got)
+		}
+	})
+
+	t.Run("merged", func(t *testing.T) {
+		got, err := mergeKeyRings([]keyringSource{shared, own})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := parseKeyRing(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string][]byte{"id-shared": []byte("shared"), "id-common": []byte("common"), "id-padded": []byte("padded1"), "id-own": []byte("own")}
+		if diff := cmp.Diff(want, keys); diff != "" {
+			t.Errorf("mergeKeyRings() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		_, err := mergeKeyRings([]keyringSource{shared, own, conflicting})
+		want := "same key-id maps to different keys in keyring secrets: key-id=id-shared secrets=shared/keyring,bar/keyring"
+		if err == nil || err.Error() != want {
+			t.Errorf("mergeKeyRings() error = %v, want %s", err, want)
+		}
+	})
+}
+
+func Test_mergeIdentities(t *testing.T) {
+	sources := []keyringSource{
+		{identityData: []byte("# description: shared\n# public key: age1shared\nAGE-SECRET-KEY-SHARED\n")},
+		{},
+		{identityData: []byte("# description: own\nAGE-SECRET-KEY-OWN\n\nAGE-SECRET-KEY-SHARED\n")},
+	}
+	want := "# description: shared\n# public key: age1shared\nAGE-SECRET-KEY-SHARED\n# description: own\nAGE-SECRET-KEY-OWN\n"
+	if got := mergeIdentities(sources); string(got) != want {
+		t.Errorf("mergeIdentities() = %s, want %s", got, want)
+	}
+	if got := mergeIdentities(sources[:2]); string(got) != string(sources[0].identityData) {
+		t.Errorf("identity of single secret should be used as is got:%s", got)
+	}
+}
+
+func Test_keyringSecretsData(t *testing.T) {
+	allowedNamespacesSecretAnnotation = "argocd.voodoobox.plugin.io/allowed-namespaces"
+
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name: "argocd-voodoobox-strongbox-keyring", Namespace: "shared",
+				Annotations: map[string]string{"argocd.voodoobox.plugin.io/allowed-namespaces": "foo"},
+			},
+			Data: map[string][]byte{
+				".strongbox_keyring":  []byte("keyentries:\n- key-id: id-shared\n  key: c2hhcmVk\n"),
+				".strongbox_identity": []byte("AGE-SECRET-KEY-SHARED\n"),
+			},
+		},
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-strongbox-keyring", Namespace: "foo"},
+			Data: map[string][]byte{
+				".strongbox_keyring": []byte("keyentries:\n- key-id: id-own\n  key: b3du\n"),
+			},
+		},
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-strongbox-keyring", Namespace: "not-shared"},
+			Data: map[string][]byte{
+				".strongbox_keyring": []byte("keyentries:\n- key-id: id-other\n  key: b3RoZXI=\n"),
+			},
+		},
+	)
+
+	app := func(namespaces ...string) applicationInfo {
+		a := applicationInfo{name: "app-foo", destinationNamespace: "foo"}
+		for _, ns := range namespaces {
+			a.keyringSecrets = append(a.keyringSecrets, secretInfo{name: "argocd-voodoobox-strongbox-keyring", namespace: ns})
+		}
+		return a
+	}
+
+	t.Run("merged", func(t *testing.T) {
+		keyringData, identityData, err := keyringSecretsData(context.Background(), app("shared", "missing", "foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := parseKeyRing(keyringData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(map[string][]byte{"id-shared": []byte("shared"), "id-own": []byte("own")}, keys); diff != "" {
+			t.Errorf("keyringSecretsData() mismatch (-want +got):\n%s", diff)
+		}
+		if string(identityData) != "AGE-SECRET-KEY-SHARED\n" {
+			t.Errorf("unexpected identity data got:%s", identityData)
+		}
+	})
+
+	t.Run("not-found", func(t *testing.T) {
+		_, _, err := keyringSecretsData(context.Background(), app("missing", "other-missing"))
+		if !errors.Is(err, errNotFound) {
+			t.Errorf("keyringSecretsData() error = %v, want %v", err, errNotFound)
+		}
+		want := "keyring secret not found: secrets=missing/argocd-voodoobox-strongbox-keyring,other-missing/argocd-voodoobox-strongbox-keyring err=not found"
+		if err == nil || err.Error() != want {
+			t.Errorf("keyringSecretsData() error = %v, want %s", err, want)
+		}
+	})
+
+	t.Run("not-allowed", func(t *testing.T) {
+		if _, _, err := keyringSecretsData(context.Background(), app("foo", "not-shared")); err == nil || errors.Is(err, errNotFound) {
+			t.Errorf("keyringSecretsData() error = %v, want not allowed error", err)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const builtinKnownHostsFilename = "builtin_known_hosts"
+
+var (
+	// builtinKnownHosts contains host keys of common git forges, it is used along
+	// with global and user known_hosts when host key verification is mandatory
+	//go:embed builtin_known_hosts
+	builtinKnownHosts []byte
+
+	// gitSSHStrictHostKeyChecking makes host key verification mandatory for all git ssh connections
+	gitSSHStrictHostKeyChecking bool
+)
+
+// writeBuiltinKnownHosts writes built-in known_hosts to ssh dir and returns its path
+func writeBuiltinKnownHosts(sshDir string) (string, error) {
+	p := filepath.Join(sshDir, builtinKnownHostsFilename)
+	if err := os.WriteFile(p, builtinKnownHosts, 0600); err != nil {
+		return "", fmt.Errorf("unable to write built-in known_hosts err:%s", err)
+	}
+	return p, nil
+}
+
+// knownHostsOptions returns ssh options to use given known_hosts files.
+// all files are set in single option as ssh only uses first value of the option.
+func knownHostsOptions(files []string, strict bool) string {
+	if len(files) == 0 {
+		return `-o UserKnownHostsFile=/dev/null -o StrictHostKeyChecking=no`
+	}
+	if len(files) == 1 {
+		opts := `-o UserKnownHostsFile=` + files[0]
+		if strict {
+			opts += ` -o StrictHostKeyChecking=yes`
+		}
+		return opts
+	}
+	opts := `-o 'UserKnownHostsFile=` + strings.Join(files, " ") + `'`
+	if strict {
+		opts += ` -o StrictHostKeyChecking=yes`
+	}
+	return opts
+}
+
+// verifyKnownHosts returns an error naming all given hosts which do not have
+// a host key in any of the given known_hosts files
+func verifyKnownHosts(hosts []string, files []string) error {
+	var patterns []string
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("unable to read known_hosts file err:%s", err)
+		}
+		p, err := knownHostPatterns(data)
+		if err != nil {
+			return fmt.Errorf("unable to parse known_hosts file: path=%s err:%s", f, err)
+		}
+		patterns = append(patterns, p...)
+	}
+
+	var missing []string
+	for _, h := range hosts {
+		if !slices.ContainsFunc(patterns, func(p string) bool { return matchKnownHost(p, h) }) {
+			missing = append(missing, h)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("host key verification is required but no known host key found: hosts=%s", strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// knownHostPatterns returns host patterns of all the non revoked keys of known_hosts data
+func knownHostPatterns(data []byte) ([]string, error) {
+	var patterns []string
+	for {
+		marker, hosts, _, _, rest, err := ssh.ParseKnownHosts(data)
+		if errors.Is(err, io.EOF) {
+			return patterns, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if marker != "revoked" {
+			patterns = append(patterns, hosts...)
+		}
+		data = rest
+	}
+}
+
+// matchKnownHost returns true if known_hosts host pattern matches given host. hashed
+// hosts, wildcards and `[host]:port` patterns are supported, negated patterns are ignored.
+func matchKnownHost(pattern, host string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		parts := strings.Split(pattern, "|")
+		if len(parts) != 4 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(host))
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil)) == parts[3]
+	}
+
+	if strings.HasPrefix(pattern, "!") {
+		return false
+	}
+	// non default port i.e. [ssh.github.com]:443
+	if strings.HasPrefix(pattern, "[") {
+		if i := strings.Index(pattern, "]"); i > 0 {
+			pattern = pattern[1:i]
+		}
+	}
+	ok, _ := path.Match(pattern, host)
+	return ok
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_matchKnownHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"github.com", "github.com", true},
+		{"github.com", "gitlab.com", false},
+		{"*.example.com", "git.example.com", true},
+		{"[ssh.github.com]:443", "ssh.github.com", true},
+		{"!github.com", "github.com", false},
+		// `ssh-keygen -H` hash of gitlab.io
+		{"|1|Vr4UnxoIW/OOQNzb7I+xE5CA3Yg=|R+HoeycrAv6pa+FIIBKaCRM4lWY=", "gitlab.io", true},
+		{"|1|Vr4UnxoIW/OOQNzb7I+xE5CA3Yg=|R+HoeycrAv6pa+FIIBKaCRM4lWY=", "github.com", false},
+	}
+	for _, tt := range tests {
+		if got := matchKnownHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchKnownHost(%s, %s) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func Test_setupGitSSHStrictHostKeyChecking(t *testing.T) {
+	gitSSHStrictHostKeyChecking = true
+	defer func() { gitSSHStrictHostKeyChecking = false }()
+
+	newApp := func(t *testing.T) string {
+		dir := filepath.Join(t.TempDir(), "app")
+		if out, err := exec.Command("cp", "-r", "./testData/app-with-remote-base", dir).CombinedOutput(); err != nil {
+			t.Fatalf("%s", out)
+		}
+		return dir
+	}
+
+	_, key := generateSSHKey(t)
+	secretData := map[string][]byte{
+		"key_a":   key,
+		"sshKeyB": key,
+		"key_c":   key,
+		"keyD":    key,
+		"keyE":    key,
+	}
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-ssh", Namespace: "foo"},
+			Data:       secretData,
+		},
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-ssh", Namespace: "bar"},
+			Data: func() map[string][]byte {
+				d := map[string][]byte{"known_hosts": []byte("gitlab.io ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAfuCHKVTjquxvt6CM6tdG4SLp1Btn/nOeHHE5UOzRdf\n")}
+				for k, v := range secretData {
+					d[k] = v
+				}
+				return d
+			}(),
+		},
+	)
+
+	t.Run("unknown-host", func(t *testing.T) {
+		app := applicationInfo{name: "foo", destinationNamespace: "foo", gitSSHSecret: secretInfo{name: "argocd-voodoobox-git-ssh"}}
+		_, err := setupGitSSH(context.Background(), newApp(t), "", "", app)
+		// github.com and bitbucket.org are part of built-in known hosts
+		if err == nil || !strings.Contains(err.Error(), "hosts=gitlab.io") {
+			t.Errorf("setupGitSSH() should fail naming host without known key got:%v", err)
+		}
+	})
+
+	t.Run("known-host-from-secret", func(t *testing.T) {
+		dir := newApp(t)
+		app := applicationInfo{name: "bar", destinationNamespace: "bar", gitSSHSecret: secretInfo{name: "argocd-voodoobox-git-ssh"}}
+		env, err := setupGitSSH(context.Background(), dir, "", "", app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "-o 'UserKnownHostsFile=" + filepath.Join(dir, ".ssh", "known_hosts") + " " + filepath.Join(dir, ".ssh", builtinKnownHostsFilename) + "' -o StrictHostKeyChecking=yes"
+		if !strings.HasSuffix(env, want) {
+			t.Errorf("setupGitSSH() env should end with %q got:%s", want, env)
+		}
+		if strings.Contains(env, "StrictHostKeyChecking=no") {
+			t.Errorf("setupGitSSH() should not disable host key checking got:%s", env)
+		}
+	})
+
+	t.Run("without-remote-base", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "app")
+		if out, err := exec.Command("cp", "-r", "./testData/app-with-secrets", dir).CombinedOutput(); err != nil {
+			t.Fatalf("%s", out)
+		}
+		env, err := setupGitSSH(context.Background(), dir, "", "", applicationInfo{name: "foo", destinationNamespace: "foo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "-o UserKnownHostsFile=" + filepath.Join(dir, ".ssh", builtinKnownHostsFilename) + " -o StrictHostKeyChecking=yes"
+		if !strings.HasSuffix(env, want) {
+			t.Errorf("setupGitSSH() env should end with %q got:%s", want, env)
+		}
+	})
+}
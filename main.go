@@ -1,15 +1,26 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
@@ -20,6 +31,11 @@ const (
 var (
 	kubeClient                        kubernetes.Interface
 	allowedNamespacesSecretAnnotation string
+	allowedProjectsSecretAnnotation   string
+	allowedAppsSecretAnnotation       string
+	// allowedNamespacesPatterns enables globs and label selector for allowed namespaces of shared secrets
+	allowedNamespacesPatterns                 bool
+	allowedNamespacesSelectorSecretAnnotation string
 
 	logger = hclog.New(&hclog.LoggerOptions{
 		Name: "argocd-voodoobox-plugin",
@@ -28,14 +44,23 @@ var (
 
 type applicationInfo struct {
 	name                 string
+	project              string
 	destinationNamespace string
-	keyringSecret        secretInfo
-	gitSSHSecret         secretInfo
+	// keyringSecrets are merged in the given order
+	keyringSecrets    []secretInfo
+	gitSSHSecret      secretInfo
+	gitHTTPSSecret    secretInfo
+	helmEnabled       bool
+	helmSecret        secretInfo
+	requirePinnedRefs bool
+	config            repoConfig
 }
 
 type secretInfo struct {
 	namespace string
 	name      string
+	// checkExpiry enables `not-after` and `rotate-by` annotations of the Secret
+	checkExpiry bool
 }
 
 var flags = []cli.Flag{
@@ -54,6 +79,18 @@ var flags = []cli.Flag{
 		Usage:    "destination application namespace ENV set by argocd",
 		Required: true,
 	},
+	&cli.StringFlag{
+		Name:    "app-project",
+		EnvVars: []string{"ARGOCD_APP_PROJECT_NAME"},
+		Usage:   "project of application ENV set by argocd",
+	},
+
+	// Argo CD CMP parameters set on Application, parameters take precedence over plugin envs
+	&cli.StringFlag{
+		Name:    "app-parameters",
+		EnvVars: []string{"ARGOCD_APP_PARAMETERS"},
+		Usage:   "JSON encoded application parameters ENV set by argocd",
+	},
 
 	// following flags/envs should be set by admin as part of plugin config
 	// Global SSH key
@@ -75,14 +112,205 @@ to get comma-separated list of all the namespaces that are allowed to use it`,
 		Destination: &allowedNamespacesSecretAnnotation,
 		Value:       "argocd.voodoobox.plugin.io/allowed-namespaces",
 	},
+	&cli.BoolFlag{
+		Name:    "allowed-namespaces-patterns",
+		EnvVars: []string{"AVP_ALLOWED_NS_PATTERNS"},
+		Usage: `if set, allowed namespaces annotation of shared secret can contain globs and namespaces can be allowed by 
+label selector annotation. since Application can be used to create namespace, it should only be enabled if namespace 
+creation is restricted`,
+		Destination: &allowedNamespacesPatterns,
+	},
+	&cli.StringFlag{
+		Name:    "allowed-namespaces-selector-secret-annotation",
+		EnvVars: []string{"AVP_ALLOWED_NS_SELECTOR_SECRET_ANNOTATION"},
+		Usage: `when shared secret is used and namespace patterns are enabled this value is the annotation key to look 
+for in secret to get label selector of all the namespaces that are allowed to use it`,
+		Destination: &allowedNamespacesSelectorSecretAnnotation,
+		Value:       "argocd.voodoobox.plugin.io/allowed-namespaces-selector",
+	},
+	&cli.StringFlag{
+		Name:    "allowed-projects-secret-annotation",
+		EnvVars: []string{"AVP_ALLOWED_PROJECTS_SECRET_ANNOTATION"},
+		Usage: `when shared secret is used this value is the annotation key to look for in secret 
+to get comma-separated list of all the argocd projects that are allowed to use it`,
+		Destination: &allowedProjectsSecretAnnotation,
+		Value:       "argocd.voodoobox.plugin.io/allowed-projects",
+	},
+	&cli.StringFlag{
+		Name:    "allowed-apps-secret-annotation",
+		EnvVars: []string{"AVP_ALLOWED_APPS_SECRET_ANNOTATION"},
+		Usage: `when shared secret is used this value is the annotation key to look for in secret 
+to get comma-separated list of all the argocd application names that are allowed to use it`,
+		Destination: &allowedAppsSecretAnnotation,
+		Value:       "argocd.voodoobox.plugin.io/allowed-apps",
+	},
+	&cli.StringFlag{
+		Name:    "not-after-secret-annotation",
+		EnvVars: []string{"AVP_NOT_AFTER_SECRET_ANNOTATION"},
+		Usage: `the annotation key to look for in keyring and git ssh secrets to get time (RFC3339 or date) after which 
+secret can't be used and builds using it fail`,
+		Destination: &notAfterSecretAnnotation,
+		Value:       "argocd.voodoobox.plugin.io/not-after",
+	},
+	&cli.StringFlag{
+		Name:    "rotate-by-secret-annotation",
+		EnvVars: []string{"AVP_ROTATE_BY_SECRET_ANNOTATION"},
+		Usage: `the annotation key to look for in keyring and git ssh secrets to get time (RFC3339 or date) after which 
+warning is logged and recorded as Event in application's namespace for each build using it`,
+		Destination: &rotateBySecretAnnotation,
+		Value:       "argocd.voodoobox.plugin.io/rotate-by",
+	},
+	&cli.StringFlag{
+		Name:    "plaintext-leak-action",
+		EnvVars: []string{"AVP_PLAINTEXT_LEAK_ACTION"},
+		Usage: `action to take when decrypted plaintext is found in non Secret objects of the build output.
+one of 'fail', 'redact' or 'warn'`,
+		Value: plaintextLeakFail,
+		Action: func(_ *cli.Context, v string) error {
+			switch v {
+			case plaintextLeakFail, plaintextLeakRedact, plaintextLeakWarn:
+				return nil
+			}
+			return fmt.Errorf("invalid plaintext-leak-action: %s", v)
+		},
+	},
+	&cli.StringFlag{
+		Name:    "allowed-remote-bases",
+		EnvVars: []string{"AVP_ALLOWED_REMOTE_BASES"},
+		Usage: `comma-separated list of hosts or repository prefixes (i.e. 'github.com/org,gitlab.com/org/repo') 
+remote bases can be fetched from, if not set remote bases are not restricted`,
+		Action: func(_ *cli.Context, v string) (err error) {
+			allowedRemoteBases, err = parseAllowedRemoteBases(v)
+			return err
+		},
+	},
+	&cli.StringFlag{
+		Name:    "remote-base-mirrors",
+		EnvVars: []string{"AVP_REMOTE_BASE_MIRRORS"},
+		Usage: `comma-separated list of 'prefix=mirror' pairs of hosts or repository prefixes 
+(i.e. 'github.com/org/=git.internal/mirror/org/') remote bases are fetched from instead`,
+		Action: func(_ *cli.Context, v string) (err error) {
+			remoteBaseMirrors, err = parseRemoteBaseMirrors(v)
+			return err
+		},
+	},
+	&cli.BoolFlag{
+		Name:    "require-pinned-refs",
+		EnvVars: []string{"AVP_REQUIRE_PINNED_REFS"},
+		Usage:   "if set, remote bases must reference a tag or full commit SHA, it can be overridden by application",
+	},
+	&cli.StringFlag{
+		Name:    "pinned-ref-tag-pattern",
+		EnvVars: []string{"AVP_PINNED_REF_TAG_PATTERN"},
+		Usage:   "regex of tag names which are considered pinned refs",
+		Value:   defaultPinnedRefTagPattern,
+		Action: func(_ *cli.Context, v string) (err error) {
+			pinnedRefTagPattern, err = regexp.Compile(v)
+			return err
+		},
+	},
+	&cli.StringFlag{
+		Name:        "remote-base-cache-dir",
+		EnvVars:     []string{"AVP_REMOTE_BASE_CACHE_DIR"},
+		Usage:       "path of the dir shared by all builds to cache remote bases, if not set remote bases are not cached",
+		Destination: &remoteBaseCacheDir,
+	},
+	&cli.DurationFlag{
+		Name:        "remote-base-cache-ttl",
+		EnvVars:     []string{"AVP_REMOTE_BASE_CACHE_TTL"},
+		Usage:       "duration after which unused remote base is evicted from the cache",
+		Destination: &remoteBaseCacheTTL,
+		Value:       remoteBaseCacheTTL,
+	},
+	&cli.StringFlag{
+		Name:    "remote-base-cache-max-size",
+		EnvVars: []string{"AVP_REMOTE_BASE_CACHE_MAX_SIZE"},
+		Usage:   "max size of the remote base cache i.e. '5Gi', least recently used remote bases are evicted once its reached",
+		Value:   "5Gi",
+		Action: func(_ *cli.Context, v string) error {
+			q, err := resource.ParseQuantity(v)
+			if err != nil {
+				return fmt.Errorf("invalid remote-base-cache-max-size: %s", v)
+			}
+			remoteBaseCacheMaxSize = q.Value()
+			return nil
+		},
+	},
+	&cli.StringFlag{
+		Name:    "result-cache-dir",
+		EnvVars: []string{"AVP_RESULT_CACHE_DIR"},
+		Usage: `path of the dir where build outputs are cached encrypted, output is reused for the same
+revision, app, source path and secret versions. if not set build outputs are not cached`,
+		Destination: &resultCacheDir,
+		Action: func(c *cli.Context, v string) error {
+			if v != "" && c.String("result-cache-identity-file") == "" {
+				return fmt.Errorf("result-cache-identity-file is required to cache build outputs")
+			}
+			return nil
+		},
+	},
+	&cli.StringFlag{
+		Name:    "result-cache-identity-file",
+		EnvVars: []string{"AVP_RESULT_CACHE_IDENTITY_FILE"},
+		Usage:   "path to age identity file used to encrypt cached build outputs",
+		Action: func(_ *cli.Context, v string) (err error) {
+			if v == "" {
+				return nil
+			}
+			resultCacheIdentity, err = parseResultCacheIdentity(v)
+			return err
+		},
+	},
+	&cli.DurationFlag{
+		Name:        "result-cache-ttl",
+		EnvVars:     []string{"AVP_RESULT_CACHE_TTL"},
+		Usage:       "duration after which cached build output is not used, remote bases with branch refs are not updated until its expired",
+		Destination: &resultCacheTTL,
+		Value:       resultCacheTTL,
+	},
+	&cli.StringFlag{
+		Name:    "secret-cache-socket",
+		EnvVars: []string{"AVP_SECRET_CACHE_SOCKET"},
+		Usage: `path of the unix socket on the shared volume where secret cache is served by 'serve' command.
+if socket doesn't exist secrets are fetched from kube API directly`,
+		Destination: &secretCacheSocket,
+	},
 
 	// following envs comes from argocd application resource
+	&cli.StringFlag{
+		Name:    "app-revision",
+		EnvVars: []string{"ARGOCD_APP_REVISION"},
+		Usage:   "revision of the application source ENV set by argocd",
+	},
+	&cli.StringFlag{
+		Name:    "app-source-path",
+		EnvVars: []string{"ARGOCD_APP_SOURCE_PATH"},
+		Usage:   "path of the application source in the repository ENV set by argocd",
+	},
+	&cli.StringFlag{
+		Name:    "app-require-pinned-refs",
+		EnvVars: []string{argocdAppEnvPrefix + "REQUIRE_PINNED_REFS"},
+		Usage:   "set to 'true' or 'false' to override server level require-pinned-refs for the application",
+		Action: func(_ *cli.Context, v string) error {
+			if _, err := strconv.ParseBool(v); v != "" && err != nil {
+				return fmt.Errorf("invalid app-require-pinned-refs: %s", v)
+			}
+			return nil
+		},
+	},
 	// strongbox secrets flags
 	&cli.StringFlag{
 		Name:    "app-strongbox-secret-namespace",
 		EnvVars: []string{argocdAppEnvPrefix + "STRONGBOX_SECRET_NAMESPACE"},
 		Usage: `set 'STRONGBOX_SECRET_NAMESPACE' in argocd application as plugin ENV. the value should be the
 name of a namespace where secret resource containing strongbox keyring is located`,
+	},
+	&cli.StringFlag{
+		Name:    "app-strongbox-secret-namespaces",
+		EnvVars: []string{argocdAppEnvPrefix + "STRONGBOX_SECRET_NAMESPACES"},
+		Usage: `set 'STRONGBOX_SECRET_NAMESPACES' in argocd application as plugin ENV. the value should be comma-separated
+list of namespaces where secret resources containing strongbox keyrings are located, keyrings and identities of
+all the secrets are merged. if set 'STRONGBOX_SECRET_NAMESPACE' is ignored`,
 	},
 	// do not set `EnvVars` for secret name flag
 	// To keep service account's permission minimum, the name of the secret is static across ALL applications.
@@ -117,6 +345,98 @@ name of a namespace where secret resource containing ssh keys are located`,
 fetching remote kustomize bases from private repositories. name will be same across all applications`,
 		Value: "argocd-voodoobox-git-ssh",
 	},
+
+	&cli.BoolFlag{
+		Name:    "git-ssh-strict-host-key-checking",
+		EnvVars: []string{"AVP_GIT_SSH_STRICT_HOST_KEY_CHECKING"},
+		Usage: `if set, host key verification is mandatory for all git ssh connections. host keys are looked up in
+global and application known_hosts along with built-in known_hosts of common git forges`,
+		Destination: &gitSSHStrictHostKeyChecking,
+	},
+	&cli.BoolFlag{
+		Name:    "allow-load-restrictor-none",
+		EnvVars: []string{"AVP_ALLOW_LOAD_RESTRICTOR_NONE"},
+		Usage: `if set, application's .voodoobox.yaml can set kustomize.loadRestrictor to LoadRestrictionsNone.
+since kustomization can then read any file of the repo server it should only be enabled if all the repositories are trusted`,
+		Destination: &allowLoadRestrictionsNone,
+	},
+	&cli.StringFlag{
+		Name:        "github-app-token-cache-dir",
+		EnvVars:     []string{"AVP_GITHUB_APP_TOKEN_CACHE_DIR"},
+		Usage:       "the path of the dir where GitHub App installation tokens are cached until expiry",
+		Destination: &githubAppTokenCacheDir,
+		Value:       filepath.Join(os.TempDir(), "argocd-voodoobox-github-app-tokens"),
+	},
+
+	// Git HTTPS flags
+	&cli.BoolFlag{
+		Name:    "app-git-https-enabled",
+		EnvVars: []string{argocdAppEnvPrefix + "GIT_HTTPS_ENABLED"},
+		Usage: `set 'GIT_HTTPS_ENABLED' in ArgoCD application as plugin ENV. If set to "true" will
+		use the Git HTTPS secret to fetch remote bases over HTTPS.`,
+	},
+	&cli.StringFlag{
+		Name:    "app-git-https-secret-namespace",
+		EnvVars: []string{argocdAppEnvPrefix + "GIT_HTTPS_SECRET_NAMESPACE"},
+		Usage: `set 'GIT_HTTPS_SECRET_NAMESPACE' in argocd application as plugin ENV. the value should be the
+name of a namespace where secret resource containing git https credentials is located`,
+	},
+	// do not set `EnvVars` for secret name flag
+	// To keep service account's permission minimum, the name of the secret is static across ALL applications.
+	// this value should only be set by admins of argocd as part of plugin setup
+	&cli.StringFlag{
+		Name: "app-git-https-secret-name",
+		Usage: `the value should be the name of a secret resource containing host and token pairs used for
+fetching remote kustomize bases from private repositories over HTTPS. name will be same across all applications`,
+		Value: "argocd-voodoobox-git-https",
+	},
+
+	// Helm flags
+	&cli.BoolFlag{
+		Name:    "app-helm-enabled",
+		EnvVars: []string{argocdAppEnvPrefix + "HELM_ENABLED"},
+		Usage: `set 'HELM_ENABLED' in ArgoCD application as plugin ENV. If set to "true"
+		kustomize helm chart inflation (helmCharts) will be enabled.`,
+	},
+	&cli.StringFlag{
+		Name:    "app-helm-secret-namespace",
+		EnvVars: []string{argocdAppEnvPrefix + "HELM_SECRET_NAMESPACE"},
+		Usage: `set 'HELM_SECRET_NAMESPACE' in argocd application as plugin ENV. the value should be the
+name of a namespace where secret resource containing helm repositories credentials is located`,
+	},
+	// do not set `EnvVars` for secret name flag
+	// To keep service account's permission minimum, the name of the secret is static across ALL applications.
+	// this value should only be set by admins of argocd as part of plugin setup
+	&cli.StringFlag{
+		Name: "app-helm-secret-name",
+		Usage: `the value should be the name of a secret resource containing credentials of private
+helm chart repositories. name will be same across all applications`,
+		Value: "argocd-voodoobox-helm",
+	},
+
+	// following flags are used to run plugin outside of the cluster (i.e. locally or in CI)
+	// to reproduce what plugin renders for an application
+	&cli.StringFlag{
+		Name:  "kubeconfig",
+		Usage: "path to kubeconfig file, if set kube client will be created from it instead of in-cluster config",
+	},
+	&cli.StringFlag{
+		Name:  "kube-context",
+		Usage: "the name of the kubeconfig context to use, defaults to current context",
+	},
+	&cli.StringFlag{
+		Name:  "local-strongbox-keyring-file",
+		Usage: "path to local strongbox keyring file, if set keyring secret will not be fetched from kube API",
+	},
+	&cli.StringFlag{
+		Name:  "local-strongbox-identity-file",
+		Usage: "path to local strongbox age identity file, if set keyring secret will not be fetched from kube API",
+	},
+	&cli.StringFlag{
+		Name: "local-git-ssh-secret-dir",
+		Usage: `path to local dir containing git ssh secret data, each file name is used as secret key (same layout as mounted secret).
+if set git ssh secret will not be fetched from kube API and custom key is enabled`,
+	},
 }
 
 func main() {
@@ -127,42 +447,81 @@ func main() {
 				Usage: "generate will decrypt all strongbox encrypted file and then run kustomize build to generate kube manifests",
 				Flags: flags,
 				Action: func(c *cli.Context) error {
+					if err := applyAppParameters(c); err != nil {
+						return err
+					}
+
 					cwd, err := os.Getwd()
 					if err != nil {
 						return fmt.Errorf("unable to get current working dir err:%s", err)
 					}
 
-					kubeClient, err = getKubeClient()
-					if err != nil {
-						return fmt.Errorf("unable to create kube clienset err:%s", err)
+					if err := setupSecretSource(c); err != nil {
+						return err
 					}
 
 					globalKeyPath := c.String("global-git-ssh-key-file")
 					globalKnownHostFile := c.String("global-git-ssh-known-hosts-file")
 
+					config, err := loadRepoConfig(cwd)
+					if err != nil {
+						return err
+					}
+
 					app := applicationInfo{
 						name:                 c.String("app-name"),
+						project:              c.String("app-project"),
 						destinationNamespace: c.String("app-namespace"),
+						config:               config,
 					}
 
 					logger = logger.With("app", app.name)
 
-					if c.Bool("app-git-ssh-enabled") {
+					if c.Bool("app-git-ssh-enabled") || c.String("local-git-ssh-secret-dir") != "" {
 						app.gitSSHSecret = secretInfo{
-							name:      c.String("app-git-ssh-secret-name"),
-							namespace: c.String("app-git-ssh-secret-namespace"),
+							name:        c.String("app-git-ssh-secret-name"),
+							namespace:   c.String("app-git-ssh-secret-namespace"),
+							checkExpiry: true,
+						}
+					}
+					if c.Bool("app-git-https-enabled") {
+						app.gitHTTPSSecret = secretInfo{
+							name:      c.String("app-git-https-secret-name"),
+							namespace: c.String("app-git-https-secret-namespace"),
+						}
+					}
+					app.requirePinnedRefs = requirePinnedRefs(c)
+					if c.Bool("app-helm-enabled") {
+						app.helmEnabled = true
+						app.helmSecret = secretInfo{
+							name:      c.String("app-helm-secret-name"),
+							namespace: c.String("app-helm-secret-namespace"),
 						}
 					}
+
+					// Always try to decrypt
+					app.keyringSecrets = keyringSecrets(c)
+
+					cacheKey, err := resultCacheKey(c, app)
+					if err != nil {
+						logger.Warn("unable to use build output cache", "err", err)
+					}
+					if manifests, ok := readResultCache(cacheKey); ok {
+						logger.Info("build output found in cache", "revision", c.String("app-revision"))
+						fmt.Printf("%s", manifests)
+						return nil
+					}
+
 					start := time.Now()
 
 					logger.Info("starting decryption")
 
-					// Always try to decrypt
-					app.keyringSecret = secretInfo{
-						name:      c.String("app-strongbox-secret-name"),
-						namespace: c.String("app-strongbox-secret-namespace"),
+					report, err := ensureDecryption(c.Context, cwd, app)
+					if err != nil {
+						return fmt.Errorf("decryption error: duration:%s error:%w", time.Since(start), err)
 					}
-					if err := ensureDecryption(c.Context, cwd, app); err != nil {
+					fingerprints, err := fingerprintDecryptedFiles(cwd, report)
+					if err != nil {
 						return fmt.Errorf("decryption error: duration:%s error:%w", time.Since(start), err)
 					}
 					decryptTime := time.Since(start)
@@ -172,18 +531,135 @@ func main() {
 					if err != nil {
 						return fmt.Errorf("build error: duration:%s error:%w", time.Since(start), err)
 					}
+					manifests, err = guardPlaintextLeaks(manifests, fingerprints, c.String("plaintext-leak-action"))
+					if err != nil {
+						return fmt.Errorf("build error: duration:%s error:%w", time.Since(start), err)
+					}
 					logger.Info("build done", "decryption-duration", decryptTime, "total-duration", time.Since(start))
 
+					if err := writeResultCache(cacheKey, manifests); err != nil {
+						logger.Warn("unable to cache build output", "err", err)
+					}
+
 					// argocd creates a temp folder of plugin which gets deleted
 					// once plugin is existed still clean up secrets manually
 					// in case this behaviour changes
 					os.Remove(filepath.Join(cwd, strongboxKeyringFilename))
 					os.RemoveAll(filepath.Join(cwd, ".ssh"))
+					os.Remove(filepath.Join(cwd, gitCredentialsFilename))
+					os.RemoveAll(filepath.Join(cwd, ".helm"))
 
 					fmt.Printf("%s", manifests)
 					return nil
 				},
 			},
+			{
+				Name:      "decrypt",
+				Usage:     "decrypt will only decrypt all strongbox encrypted files in place and print report of decrypted files",
+				ArgsUsage: "[dir]",
+				Flags:     flags,
+				Action: func(c *cli.Context) error {
+					if err := applyAppParameters(c); err != nil {
+						return err
+					}
+
+					cwd := c.Args().First()
+					if cwd == "" {
+						var err error
+						if cwd, err = os.Getwd(); err != nil {
+							return fmt.Errorf("unable to get current working dir err:%s", err)
+						}
+					}
+
+					if err := setupSecretSource(c); err != nil {
+						return err
+					}
+
+					config, err := loadRepoConfig(cwd)
+					if err != nil {
+						return err
+					}
+
+					app := applicationInfo{
+						name:                 c.String("app-name"),
+						project:              c.String("app-project"),
+						destinationNamespace: c.String("app-namespace"),
+						keyringSecrets:       keyringSecrets(c),
+						config:               config,
+					}
+					// unlike generate, decrypt is used to debug decryption so missing keyring is an error
+					app.config.Policy.RequireKeyring = true
+
+					logger = logger.With("app", app.name)
+
+					report, err := ensureDecryption(c.Context, cwd, app)
+					if err != nil {
+						return fmt.Errorf("decryption error: %w", err)
+					}
+
+					// keyring files are only needed for generate
+					os.Remove(filepath.Join(cwd, strongboxKeyringFilename))
+					os.Remove(filepath.Join(cwd, strongboxIdentityFilename))
+
+					return printDecryptionReport(os.Stdout, report)
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "serve runs secret cache which watches keyring and git ssh secrets across all namespaces and serves them to generate and decrypt over unix socket",
+				Flags: flags,
+				Action: func(c *cli.Context) error {
+					if secretCacheSocket == "" {
+						return fmt.Errorf("secret-cache-socket is required to serve secrets")
+					}
+
+					client, err := getKubeClient(c.String("kubeconfig"), c.String("kube-context"))
+					if err != nil {
+						return fmt.Errorf("unable to create kube clienset err:%s", err)
+					}
+
+					ctx, stop := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+
+					// only keyring and git ssh secrets are cached to keep list and watch access minimum,
+					// other secrets are fetched from kube API
+					return runSecretCacheServer(ctx, client, secretCacheSocket, []string{
+						c.String("app-strongbox-secret-name"),
+						c.String("app-git-ssh-secret-name"),
+					})
+				},
+			},
+			{
+				Name:  "announce-parameters",
+				Usage: "announce-parameters prints supported application parameters for argocd UI",
+				Action: func(c *cli.Context) error {
+					return announceParameters(os.Stdout)
+				},
+			},
+			{
+				Name:            "helm-wrapper",
+				Usage:           "helm-wrapper is used as helm command by kustomize to add private chart repositories credentials",
+				Hidden:          true,
+				SkipFlagParsing: true,
+				Action: func(c *cli.Context) error {
+					if err := runHelmWrapper(c.Args().Slice()); err != nil {
+						var exitErr *exec.ExitError
+						if errors.As(err, &exitErr) {
+							return cli.Exit("", exitErr.ExitCode())
+						}
+						return err
+					}
+					return nil
+				},
+			},
+			{
+				Name:   "strongbox-smudge",
+				Usage:  "strongbox-smudge is used as git smudge filter to decrypt files of remote bases",
+				Hidden: true,
+				Action: func(c *cli.Context) error {
+					return smudge(os.Stdin, os.Stdout, os.Getenv("STRONGBOX_HOME"))
+				},
+			},
 		},
 	}
 
@@ -193,7 +669,79 @@ func main() {
 	}
 }
 
-func getKubeClient() (*kubernetes.Clientset, error) {
+// printDecryptionReport prints path, format and key used for each decrypted file
+func printDecryptionReport(out io.Writer, report []decryptedFile) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tFORMAT\tKEY")
+	for _, f := range report {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.path, f.format, f.key)
+	}
+	fmt.Fprintf(w, "\n%d file(s) decrypted\n", len(report))
+	return w.Flush()
+}
+
+// setupSecretSource loads secrets from local files if configured and creates
+// kube client. kube client is not created if all secrets are read from local files
+// and kubeconfig is not set
+func setupSecretSource(c *cli.Context) error {
+	localSecrets = make(map[string]*v1.Secret)
+
+	keyringData := make(map[string][]byte)
+	if f := c.String("local-strongbox-keyring-file"); f != "" {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("unable to read local keyring file err:%s", err)
+		}
+		keyringData[strongboxKeyringFilename] = data
+	}
+	if f := c.String("local-strongbox-identity-file"); f != "" {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("unable to read local identity file err:%s", err)
+		}
+		keyringData[strongboxIdentityFilename] = data
+	}
+	if len(keyringData) > 0 {
+		localSecrets[c.String("app-strongbox-secret-name")] = localSecret(c.String("app-strongbox-secret-name"), keyringData)
+	}
+
+	if dir := c.String("local-git-ssh-secret-dir"); dir != "" {
+		data, err := readLocalSecretDir(dir)
+		if err != nil {
+			return fmt.Errorf("unable to read local git ssh secret dir err:%s", err)
+		}
+		localSecrets[c.String("app-git-ssh-secret-name")] = localSecret(c.String("app-git-ssh-secret-name"), data)
+	}
+
+	needsKubeAPI := len(keyringData) == 0 || (c.Bool("app-git-ssh-enabled") && c.String("local-git-ssh-secret-dir") == "") ||
+		c.Bool("app-git-https-enabled")
+	if !needsKubeAPI && c.String("kubeconfig") == "" && c.String("kube-context") == "" {
+		return nil
+	}
+
+	var err error
+	kubeClient, err = getKubeClient(c.String("kubeconfig"), c.String("kube-context"))
+	if err != nil {
+		return fmt.Errorf("unable to create kube clienset err:%s", err)
+	}
+	return nil
+}
+
+// getKubeClient creates kube clientset from given kubeconfig and context,
+// if both are empty in-cluster config is used
+func getKubeClient(kubeconfig, kubeContext string) (*kubernetes.Clientset, error) {
+	if kubeconfig != "" || kubeContext != "" {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = kubeconfig
+		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			rules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+		).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("unable to create config from kubeconfig err:%s", err)
+		}
+		return kubernetes.NewForConfig(config)
+	}
+
 	// creates the in-cluster config
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// remoteBaseMirrors is the server level rewrite table of remote bases to the internal mirrors
+var remoteBaseMirrors []remoteBaseMirror
+
+// remoteBaseMirror rewrites remote bases matching the prefix to the mirror
+type remoteBaseMirror struct {
+	prefix remoteBasePrefix
+	mirror remoteBasePrefix
+}
+
+// parseRemoteBaseMirrors parses comma-separated list of `prefix=mirror` pairs of hosts or
+// repository prefixes i.e. `github.com/org/=git.internal/mirror/org/,gitlab.com=git.internal/gitlab`
+func parseRemoteBaseMirrors(v string) ([]remoteBaseMirror, error) {
+	var mirrors []remoteBaseMirror
+	for _, e := range strings.Split(v, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("remote base mirror should be in 'prefix=mirror' format: %s", e)
+		}
+		var m remoteBaseMirror
+		m.prefix.host, m.prefix.path = splitRemoteURL(strings.TrimSpace(from))
+		m.mirror.host, m.mirror.path = splitRemoteURL(strings.TrimSpace(to))
+		if m.prefix.host == "" || m.mirror.host == "" || strings.ContainsAny(e, `*?[]\`) {
+			return nil, fmt.Errorf("invalid remote base mirror: %s", e)
+		}
+		// rest of the repository path is appended to the mirror path
+		if m.prefix.path != "" && m.mirror.path == "" {
+			return nil, fmt.Errorf("mirror of repository prefix should contain path: %s", e)
+		}
+		mirrors = append(mirrors, m)
+	}
+	return mirrors, nil
+}
+
+// insteadOf returns git config rewriting URLs of the prefix starting with the given
+// base i.e. `https://github.com/` to the URL of the mirror starting with the mirror base
+func (m remoteBaseMirror) insteadOf(base, mirrorBase string) string {
+	mirror := mirrorBase + m.mirror.path
+	if m.prefix.path == "" && m.mirror.path != "" {
+		mirror += "/"
+	}
+	return fmt.Sprintf(gitConfigInsteadOfFragment, mirror, base+m.prefix.path)
+}
+
+// sshInsteadOf returns git config rewriting all forms of the ssh URLs of the given
+// host to the mirror host, hosts can be aliased with key names
+func (m remoteBaseMirror) sshInsteadOf(host, mirrorHost string) string {
+	return m.insteadOf("ssh://"+host+"/", "ssh://"+mirrorHost+"/") +
+		m.insteadOf("ssh://git@"+host+"/", "ssh://git@"+mirrorHost+"/") +
+		m.insteadOf("git@"+host+":", "git@"+mirrorHost+":")
+}
+
+// writeRemoteBaseMirrorsGitConfig configures git to fetch remote bases matching the
+// prefixes from the mirrors. config is conditionally included based on the URL of the
+// remote so that prefix only matches whole path segments and mirrors also apply to the
+// remote bases referenced by other remote bases. git uses the longest matching `insteadOf`
+// and on ties the `url` section defined first, so it must be written after config of the
+// ssh keys for mirrors of the repo map to keep the key.
+func writeRemoteBaseMirrorsGitConfig(cwd string, mirrors []remoteBaseMirror) error {
+	var config strings.Builder
+	for i, m := range mirrors {
+		include := m.insteadOf("https://"+m.prefix.host+"/", "https://"+m.mirror.host+"/") +
+			m.sshInsteadOf(m.prefix.host, m.mirror.host)
+
+		includeFile := filepath.Join(cwd, fmt.Sprintf(".remote-base-mirror-%d.gitconfig", i))
+		if err := os.WriteFile(includeFile, []byte(include), 0600); err != nil {
+			return fmt.Errorf("unable to write remote base mirror git config err:%s", err)
+		}
+
+		paths := repoPathGlobs(m.prefix.path)
+		globs := sshURLGlobs(m.prefix.host, paths)
+		for _, p := range paths {
+			globs = append(globs, "https://"+m.prefix.host+"/"+p)
+		}
+		for _, g := range globs {
+			fmt.Fprintf(&config, gitConfigIncludeIfFragment, g, includeFile)
+		}
+	}
+	return appendGitConfig(cwd, config.String())
+}
+
+// writeKeyedMirrorsGitConfig configures git to rewrite ssh URLs with domain replaced by the
+// key name i.e. `key_a_github_com` to the mirror host aliased with the same key, so that key
+// selected for the repository is used to fetch it from the mirror. it returns mirror hosts
+// of the keys which should be added to the ssh config.
+func writeKeyedMirrorsGitConfig(cwd, sshDir string, mirrors []remoteBaseMirror, keyNames []string) ([]repoMapEntry, error) {
+	slices.Sort(keyNames)
+
+	var hosts []repoMapEntry
+	var config strings.Builder
+	for i, m := range mirrors {
+		for _, k := range keyNames {
+			alias := hostAlias(k, m.prefix.host)
+
+			includeFile := filepath.Join(sshDir, fmt.Sprintf("mirror_%d_%s.gitconfig", i, k))
+			if err := os.WriteFile(includeFile, []byte(m.sshInsteadOf(alias, hostAlias(k, m.mirror.host))), 0600); err != nil {
+				return nil, fmt.Errorf("unable to write remote base mirror git config err:%s", err)
+			}
+			for _, g := range sshURLGlobs(alias, repoPathGlobs(m.prefix.path)) {
+				fmt.Fprintf(&config, gitConfigIncludeIfFragment, g, includeFile)
+			}
+			hosts = append(hosts, repoMapEntry{host: m.mirror.host, key: k})
+		}
+	}
+	return hosts, appendGitConfig(cwd, config.String())
+}
+
+// mirroredRemoteBases returns allowlist of remote bases along with the mirrors,
+// so that ssh can connect to the mirror hosts of the allowed remote bases
+func mirroredRemoteBases(allowed []remoteBasePrefix, mirrors []remoteBaseMirror) []remoteBasePrefix {
+	if len(allowed) == 0 {
+		return nil
+	}
+	allowed = slices.Clone(allowed)
+	for _, m := range mirrors {
+		if !slices.Contains(allowed, m.mirror) {
+			allowed = append(allowed, m.mirror)
+		}
+	}
+	return allowed
+}
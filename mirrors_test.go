@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_parseRemoteBaseMirrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		v          string
+		want       []remoteBaseMirror
+		wantErrMsg string
+	}{
+		{"all-forms", "github.com/org/=git.internal/mirror/org/, gitlab.com=git.internal/gitlab,ssh://git@bitbucket.org/team=git.internal/team", []remoteBaseMirror{
+			{prefix: remoteBasePrefix{host: "github.com", path: "org"}, mirror: remoteBasePrefix{host: "git.internal", path: "mirror/org"}},
+			{prefix: remoteBasePrefix{host: "gitlab.com"}, mirror: remoteBasePrefix{host: "git.internal", path: "gitlab"}},
+			{prefix: remoteBasePrefix{host: "bitbucket.org", path: "team"}, mirror: remoteBasePrefix{host: "git.internal", path: "team"}},
+		}, ""},
+		{"missing-mirror", "github.com/org", nil, "remote base mirror should be in 'prefix=mirror' format: github.com/org"},
+		{"glob", "github.com/*=git.internal", nil, "invalid remote base mirror: github.com/*=git.internal"},
+		{"mirror-without-path", "github.com/org=git.internal", nil, "mirror of repository prefix should contain path: github.com/org=git.internal"},
+		{"empty-mirror", "github.com/org=", nil, "invalid remote base mirror: github.com/org="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRemoteBaseMirrors(tt.v)
+			if tt.wantErrMsg != "" {
+				if err == nil || err.Error() != tt.wantErrMsg {
+					t.Fatalf("parseRemoteBaseMirrors() error = %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(remoteBaseMirror{}, remoteBasePrefix{})); diff != "" {
+				t.Errorf("parseRemoteBaseMirrors() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_writeRemoteBaseMirrorsGitConfig(t *testing.T) {
+	mirrors, err := parseRemoteBaseMirrors("github.com/org/=git.internal/mirror/org/,gitlab.com=git.internal/gitlab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd := t.TempDir()
+	if err := writeRemoteBaseMirrorsGitConfig(cwd, mirrors); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/org/repo1", "https://git.internal/mirror/org/repo1"},
+		{"https://github.com/org/repo1.git", "https://git.internal/mirror/org/repo1.git"},
+		{"ssh://github.com/org/repo1", "ssh://git.internal/mirror/org/repo1"},
+		{"ssh://git@github.com/org/repo1", "ssh://git@git.internal/mirror/org/repo1"},
+		{"git@github.com:org/repo1", "git@git.internal:mirror/org/repo1"},
+		{"https://github.com/org2/repo1", "https://github.com/org2/repo1"},
+		{"https://gitlab.com/team/repo", "https://git.internal/gitlab/team/repo"},
+		{"git@gitlab.com:team/repo", "git@git.internal:gitlab/team/repo"},
+		{"https://bitbucket.org/org/repo", "https://bitbucket.org/org/repo"},
+	}
+	for _, tt := range tests {
+		repo := t.TempDir()
+		for _, args := range [][]string{{"init", "-q"}, {"remote", "add", "origin", tt.url}} {
+			git(t, cwd, repo, args...)
+		}
+		if got := git(t, cwd, repo, "remote", "get-url", "origin"); got != tt.want {
+			t.Errorf("url=%s got=%s want=%s", tt.url, got, tt.want)
+		}
+	}
+}
+
+func Test_setupGitSSHMirrors(t *testing.T) {
+	mirrors, err := parseRemoteBaseMirrors("github.com/org=git.internal/mirror/org,gitlab.io=git.internal/gitlab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteBaseMirrors = mirrors
+	defer func() { remoteBaseMirrors = nil }()
+
+	_, key := generateSSHKey(t)
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-ssh", Namespace: "foo"},
+			Data: map[string][]byte{
+				"key_a":   key,
+				"sshKeyB": key,
+				"repo_map": []byte(`
+github.com/org/*-infra   sshKeyB
+gitlab.io                sshKeyB
+`),
+			},
+		},
+	)
+
+	cwd := t.TempDir()
+	k := "resources:\n  # argocd-voodoobox-plugin: key_a\n  - ssh://github.com/org/repo1//base?ref=main\n"
+	if err := os.WriteFile(filepath.Join(cwd, "kustomization.yaml"), []byte(k), 0600); err != nil {
+		t.Fatal(err)
+	}
+	app := applicationInfo{
+		name:                 "app-foo",
+		destinationNamespace: "foo",
+		gitSSHSecret:         secretInfo{name: "argocd-voodoobox-git-ssh"},
+	}
+	if _, err := setupGitSSH(context.Background(), cwd, "", "", app); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRemoteBaseMirrorsGitConfig(cwd, mirrors); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := os.ReadFile(filepath.Join(cwd, ".ssh", "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"Host key_a_git_internal\n    HostName git.internal\n", "Host sshKeyB_git_internal\n    HostName git.internal\n"} {
+		if strings.Count(string(config), host) != 1 {
+			t.Errorf("ssh config should contain %q once\n%s", host, config)
+		}
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		// domain replaced with key name by key comment
+		{"ssh://key_a_github_com/org/repo1", "ssh://key_a_git_internal/mirror/org/repo1"},
+		{"ssh://git@key_a_github_com/org/repo1", "ssh://git@key_a_git_internal/mirror/org/repo1"},
+		{"git@key_a_github_com:org/repo1", "git@key_a_git_internal:mirror/org/repo1"},
+		// repo map
+		{"ssh://github.com/org/app-infra", "ssh://sshKeyB_git_internal/mirror/org/app-infra"},
+		{"git@gitlab.io:team/repo", "git@sshKeyB_git_internal:gitlab/team/repo"},
+		// mirror without prefix path has same insteadOf as repo map
+		{"ssh://git@gitlab.io/team/repo", "ssh://git@sshKeyB_git_internal/gitlab/team/repo"},
+		// mirror without key
+		{"ssh://github.com/org/repo2", "ssh://git.internal/mirror/org/repo2"},
+		// not mirrored
+		{"ssh://github.com/other/app-infra", "ssh://github.com/other/app-infra"},
+		{"ssh://key_a_github_com/other/repo1", "ssh://key_a_github_com/other/repo1"},
+	}
+	for _, tt := range tests {
+		repo := t.TempDir()
+		for _, args := range [][]string{{"init", "-q"}, {"remote", "add", "origin", tt.url}} {
+			git(t, cwd, repo, args...)
+		}
+		if got := git(t, cwd, repo, "remote", "get-url", "origin"); got != tt.want {
+			t.Errorf("url=%s got=%s want=%s", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/urfave/cli/v2"
+)
+
+// appParameter is a single Argo CD CMP parameter as passed to plugin
+// via `ARGOCD_APP_PARAMETERS` env
+// https://argo-cd.readthedocs.io/en/stable/proposals/parameterized-config-management-plugins/
+type appParameter struct {
+	Name   string            `json:"name"`
+	String *string           `json:"string,omitempty"`
+	Array  []string          `json:"array,omitempty"`
+	Map    map[string]string `json:"map,omitempty"`
+}
+
+// parameterAnnouncement describes parameter to Argo CD, so that it can be
+// displayed in the UI. it is printed by `announce-parameters` command
+type parameterAnnouncement struct {
+	Name           string `json:"name"`
+	Title          string `json:"title,omitempty"`
+	Tooltip        string `json:"tooltip,omitempty"`
+	Required       bool   `json:"required,omitempty"`
+	ItemType       string `json:"itemType,omitempty"`
+	CollectionType string `json:"collectionType,omitempty"`
+	String         string `json:"string,omitempty"`
+}
+
+// supportedParameter maps CMP parameter to the flag it sets
+type supportedParameter struct {
+	announcement parameterAnnouncement
+	flag         string
+}
+
+// supportedParameters are all the application level parameters. parameters
+// set on Application take precedence over corresponding `ARGOCD_ENV_*` envs
+var supportedParameters = []supportedParameter{
+	{
+		announcement: parameterAnnouncement{
+			Name:     "strongbox-secret-namespace",
+			Title:    "Strongbox secret namespace",
+			Tooltip:  "the name of a namespace where secret resource containing strongbox keyring is located, defaults to destination namespace",
+			ItemType: "string",
+		},
+		flag: "app-strongbox-secret-namespace",
+	},
+	{
+		announcement: parameterAnnouncement{
+			Name:     "strongbox-secret-namespaces",
+			Title:    "Strongbox secret namespaces",
+			Tooltip:  "comma-separated list of namespaces where secret resources containing strongbox keyrings are located, keyrings of all the secrets are merged",
+			ItemType: "string",
+		},
+		flag: "app-strongbox-secret-namespaces",
+	},
+	{
+		announcement: parameterAnnouncement{
+			Name:     "git-ssh-custom-key-enabled",
+			Title:    "Git SSH custom key enabled",
+			Tooltip:  "if set to 'true' the Git SSH secret will be used to fetch remote bases",
+			ItemType: "boolean",
+			String:   "false",
+		},
+		flag: "app-git-ssh-enabled",
+	},
+	{
+		announcement: parameterAnnouncement{
+			Name:     "git-ssh-secret-namespace",
+			Title:    "Git SSH secret namespace",
+			Tooltip:  "the name of a namespace where secret resource containing ssh keys is located, defaults to destination namespace",
+			ItemType: "string",
+		},
+		flag: "app-git-ssh-secret-namespace",
+	},
+	{
+		announcement: parameterAnnouncement{
+			Name:     "git-https-enabled",
+			Title:    "Git HTTPS enabled",
+			Tooltip:  "if set to 'true' the Git HTTPS secret will be used to fetch remote bases over HTTPS",
+			ItemType: "boolean",
+			String:   "false",
+		},
+		flag: "app-git-https-enabled",
+	},
+	{
+		announcement: parameterAnnouncement{
+			Name:     "git-https-secret-namespace",
+			Title:    "Git HTTPS secret namespace",
+			Tooltip:  "the name of a namespace where secret resource containing git https credentials is located, defaults to destination namespace",
+			ItemType: "string",
+		},
+		flag: "app-git-https-secret-namespace",
+	},
+	{
+		announcement: parameterAnnouncement{
+			Name:     "helm-enabled",
+			Title:    "Helm enabled",
+			Tooltip:  "if set to 'true' kustomize helm chart inflation (helmCharts) will be enabled",
+			ItemType: "boolean",
+			String:   "false",
+		},
+		flag: "app-helm-enabled",
+	},
+	{
+		announcement: parameterAnnouncement{
+			Name:     "helm-secret-namespace",
+			Title:    "Helm secret namespace",
+			Tooltip:  "the name of a namespace where secret resource containing helm repositories credentials is located, defaults to destination namespace",
+			ItemType: "string",
+		},
+		flag: "app-helm-secret-namespace",
+	},
+	{
+		announcement: parameterAnnouncement{
+			Name:     "require-pinned-refs",
+			Title:    "Require pinned refs",
+			Tooltip:  "if set to 'true' remote bases must reference a tag or full commit SHA, if set to 'false' server default is overridden",
+			ItemType: "boolean",
+		},
+		flag: "app-require-pinned-refs",
+	},
+}
+
+// applyAppParameters parses Argo CD CMP parameters and sets corresponding flags.
+// since flags are set after envs are read, parameters take precedence over envs
+func applyAppParameters(c *cli.Context) error {
+	raw := c.String("app-parameters")
+	if raw == "" {
+		return nil
+	}
+
+	var params []appParameter
+	if err := json.Unmarshal([]byte(raw), &params); err != nil {
+		return fmt.Errorf("unable to parse application parameters err:%s", err)
+	}
+
+	for _, p := range params {
+		sp, ok := lookupParameter(p.Name)
+		if !ok {
+			logger.Warn("ignoring unsupported application parameter", "parameter", p.Name)
+			continue
+		}
+		if p.String == nil {
+			return fmt.Errorf("application parameter must be a string: parameter=%s", p.Name)
+		}
+		if err := c.Set(sp.flag, *p.String); err != nil {
+			return fmt.Errorf("invalid application parameter value: parameter=%s err:%s", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func lookupParameter(name string) (supportedParameter, bool) {
+	for _, sp := range supportedParameters {
+		if sp.announcement.Name == name {
+			return sp, true
+		}
+	}
+	return supportedParameter{}, false
+}
+
+// announceParameters prints all supported parameters in the format
+// expected from Argo CD `parameters.dynamic` command
+func announceParameters(out io.Writer) error {
+	announcements := make([]parameterAnnouncement, 0, len(supportedParameters))
+	for _, sp := range supportedParameters {
+		announcements = append(announcements, sp.announcement)
+	}
+	return json.NewEncoder(out).Encode(announcements)
+}
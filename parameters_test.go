@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/urfave/cli/v2"
+)
+
+func Test_applyAppParameters(t *testing.T) {
+	type appFlags struct {
+		strongboxNamespace string
+		gitSSHEnabled      bool
+		gitSSHNamespace    string
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		params  string
+		want    appFlags
+		wantErr bool
+	}{
+		{
+			"only-envs",
+			map[string]string{"ARGOCD_ENV_STRONGBOX_SECRET_NAMESPACE": "env-ns", "ARGOCD_ENV_GIT_SSH_CUSTOM_KEY_ENABLED": "true"},
+			"",
+			appFlags{strongboxNamespace: "env-ns", gitSSHEnabled: true},
+			false,
+		},
+		{
+			"params-override-envs",
+			map[string]string{"ARGOCD_ENV_STRONGBOX_SECRET_NAMESPACE": "env-ns", "ARGOCD_ENV_GIT_SSH_CUSTOM_KEY_ENABLED": "true"},
+			`[{"name":"strongbox-secret-namespace","string":"param-ns"},{"name":"git-ssh-custom-key-enabled","string":"false"},{"name":"git-ssh-secret-namespace","string":"ssh-ns"}]`,
+			appFlags{strongboxNamespace: "param-ns", gitSSHEnabled: false, gitSSHNamespace: "ssh-ns"},
+			false,
+		},
+		{
+			"unknown-param-ignored",
+			nil,
+			`[{"name":"foo","string":"bar"}]`,
+			appFlags{},
+			false,
+		},
+		{
+			"invalid-json",
+			nil,
+			`[{"name":`,
+			appFlags{},
+			true,
+		},
+		{
+			"invalid-bool",
+			nil,
+			`[{"name":"git-ssh-custom-key-enabled","string":"yes please"}]`,
+			appFlags{},
+			true,
+		},
+		{
+			"non-string-param",
+			nil,
+			`[{"name":"strongbox-secret-namespace","array":["a","b"]}]`,
+			appFlags{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ARGOCD_APP_NAME", "foo")
+			t.Setenv("ARGOCD_APP_NAMESPACE", "bar")
+			t.Setenv("ARGOCD_APP_PARAMETERS", tt.params)
+			// flags are shared between runs so reset all envs
+			t.Setenv("ARGOCD_ENV_STRONGBOX_SECRET_NAMESPACE", "")
+			t.Setenv("ARGOCD_ENV_GIT_SSH_CUSTOM_KEY_ENABLED", "")
+			t.Setenv("ARGOCD_ENV_GIT_SSH_SECRET_NAMESPACE", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			var got appFlags
+			app := &cli.App{
+				Commands: []*cli.Command{{
+					Name:  "test",
+					Flags: flags,
+					Action: func(c *cli.Context) error {
+						if err := applyAppParameters(c); err != nil {
+							return err
+						}
+						got = appFlags{
+							strongboxNamespace: c.String("app-strongbox-secret-namespace"),
+							gitSSHEnabled:      c.Bool("app-git-ssh-enabled"),
+							gitSSHNamespace:    c.String("app-git-ssh-secret-namespace"),
+						}
+						return nil
+					},
+				}},
+			}
+
+			err := app.Run([]string{"plugin", "test"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("applyAppParameters() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(appFlags{})); diff != "" {
+				t.Errorf("applyAppParameters() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_announceParameters(t *testing.T) {
+	var out bytes.Buffer
+	if err := announceParameters(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []parameterAnnouncement
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(supportedParameters) {
+		t.Fatalf("announceParameters() got %d parameters want %d", len(got), len(supportedParameters))
+	}
+	for i, sp := range supportedParameters {
+		if diff := cmp.Diff(sp.announcement, got[i]); diff != "" {
+			t.Errorf("announceParameters() mismatch (-want +got):\n%s", diff)
+		}
+		// all parameters must map to existing flags
+		found := false
+		for _, f := range flags {
+			for _, n := range f.Names() {
+				if n == sp.flag {
+					found = true
+				}
+			}
+		}
+		if !found {
+			t.Errorf("parameter %s references unknown flag %s", sp.announcement.Name, sp.flag)
+		}
+	}
+}
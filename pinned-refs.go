@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+const defaultPinnedRefTagPattern = `^v?[0-9]+(\.[0-9]+)*([-+][0-9A-Za-z.-]+)?$`
+
+var (
+	// pinnedRefTagPattern is the pattern of tags which are considered pinned refs, since
+	// branch can have same name refs matching it are also resolved with `git ls-remote`
+	pinnedRefTagPattern = regexp.MustCompile(defaultPinnedRefTagPattern)
+
+	// full SHA-1 or SHA-256 commit hash
+	reCommitSHA = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+)
+
+// requirePinnedRefs returns application override if set otherwise server default
+func requirePinnedRefs(c *cli.Context) bool {
+	if v, err := strconv.ParseBool(c.String("app-require-pinned-refs")); err == nil {
+		return v
+	}
+	return c.Bool("require-pinned-refs")
+}
+
+// remoteBaseRef returns `ref` (or its alias `version`) query param of the remote base URL
+func remoteBaseRef(u string) string {
+	_, query, ok := strings.Cut(u, "?")
+	if !ok {
+		return ""
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return ""
+	}
+	if ref := values.Get("ref"); ref != "" {
+		return ref
+	}
+	return values.Get("version")
+}
+
+// isPinnedRef returns true if ref is a full commit SHA or a tag matching the pattern,
+// remote bases without ref use default branch so empty ref is not pinned
+func isPinnedRef(ref string) bool {
+	return reCommitSHA.MatchString(ref) || pinnedRefTagPattern.MatchString(ref)
+}
+
+// checkPinnedRefs returns error naming all remote bases of given kustomization
+// files which do not reference a tag or a full commit SHA
+func checkPinnedRefs(kFiles []string) error {
+	refs, err := kustomizationRemoteRefs(kFiles)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, r := range refs {
+		// helm chart repository is not a git repository
+		if r.field == "helmCharts" {
+			continue
+		}
+		if !isPinnedRef(remoteBaseRef(r.node.Value)) {
+			errs = append(errs, fmt.Errorf("path=%s line=%d url=%s", r.path, r.node.Line, r.node.Value))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("remote base ref must be a tag or full commit SHA: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// verifyPinnedRefTags resolves refs of given kustomization files which are not commit SHAs
+// using `git ls-remote` with the git env of the build and returns error naming all remote
+// bases whose ref is not a tag of the repository or is also the name of a branch.
+func verifyPinnedRefTags(ctx context.Context, kFiles []string, env []string) error {
+	refs, err := kustomizationRemoteRefs(kFiles)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, r := range refs {
+		if r.field == "helmCharts" {
+			continue
+		}
+		cloneURL, ref, ok := remoteBaseCloneURL(r.node.Value)
+		if !ok {
+			errs = append(errs, fmt.Errorf("path=%s line=%d url=%s err:unable to parse repository URL", r.path, r.node.Line, r.node.Value))
+			continue
+		}
+		if reCommitSHA.MatchString(ref) {
+			continue
+		}
+		out, err := runGit(ctx, env, "ls-remote", "--heads", "--tags", cloneURL, ref)
+		if err != nil {
+			return fmt.Errorf("unable to resolve remote base ref: path=%s line=%d url=%s err:%s", r.path, r.node.Line, r.node.Value, err)
+		}
+		switch isTag, isBranch := lsRemoteRefKind(out, ref); {
+		case isBranch:
+			errs = append(errs, fmt.Errorf("path=%s line=%d url=%s err:ref is a branch", r.path, r.node.Line, r.node.Value))
+		case !isTag:
+			errs = append(errs, fmt.Errorf("path=%s line=%d url=%s err:tag not found", r.path, r.node.Line, r.node.Value))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("remote base ref must be a tag or full commit SHA: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// lsRemoteRefKind returns whether the ref is a tag and a branch of the repository
+// based on `git ls-remote --heads --tags` output
+func lsRemoteRefKind(out, ref string) (isTag, isBranch bool) {
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		_, name, _ := strings.Cut(line, "\t")
+		switch strings.TrimSuffix(name, "^{}") {
+		case "refs/tags/" + ref:
+			isTag = true
+		case "refs/heads/" + ref:
+			isBranch = true
+		}
+	}
+	return isTag, isBranch
+}
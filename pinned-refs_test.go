@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func Test_isPinnedRef(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"ssh://github.com/org/repo1//manifests/lab-foo?ref=master", false},
+		{"https://github.com/org/repo1//manifests", false},
+		{"https://github.com/org/repo1//manifests?ref=", false},
+		{"https://github.com/org/repo1//manifests?ref=release-v1.2", false},
+		{"https://github.com/org/repo1//manifests?ref=v1.2.3", true},
+		{"https://github.com/org/repo1//manifests?ref=1.2.3-rc.1", true},
+		{"https://github.com/org/repo1//manifests?version=v1.2.3", true},
+		{"https://github.com/org/repo1//manifests?timeout=10s&ref=7f0d7ad4ef2dbfc7ffd1c5b0a6e4e0c1d2f5ba2c", true},
+		{"https://github.com/org/repo1//manifests?ref=7f0d7ad", false},
+	}
+	for _, tt := range tests {
+		if got := isPinnedRef(remoteBaseRef(tt.url)); got != tt.want {
+			t.Errorf("isPinnedRef(%s) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func Test_checkPinnedRefs(t *testing.T) {
+	kFiles, err := findKustomizeFiles("testData/app-with-remote-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantErrMsg := `remote base ref must be a tag or full commit SHA: path=testData/app-with-remote-base/app/kustomization.yml line=7 url=ssh://github.com/org/repo5//manifests/foo?ref=master
+path=testData/app-with-remote-base/kustomization.yaml line=6 url=github.com/org/open1//manifests/lab-foo?ref=master
+path=testData/app-with-remote-base/kustomization.yaml line=8 url=ssh://github.com/org/repo1//manifests/lab-foo?ref=master
+path=testData/app-with-remote-base/kustomization.yaml line=10 url=ssh://github.com/org/repo3//manifests/lab-zoo?ref=dev
+path=testData/app-with-remote-base/kustomization.yaml line=12 url=ssh://gitlab.io/org/repo2//manifests/lab-bar?ref=main
+path=testData/app-with-remote-base/kustomization.yaml line=14 url=ssh://bitbucket.org/org/repo3//manifests/lab-zoo?ref=dev`
+	err = checkPinnedRefs(kFiles)
+	if err == nil || err.Error() != wantErrMsg {
+		t.Errorf("checkPinnedRefs() error = %v, want %s", err, wantErrMsg)
+	}
+
+	// local resources are not checked
+	kFiles, err = findKustomizeFiles("testData/app-with-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPinnedRefs(kFiles); err != nil {
+		t.Errorf("checkPinnedRefs() unexpected error = %v", err)
+	}
+}
+
+func Test_verifyPinnedRefTags(t *testing.T) {
+	root := t.TempDir()
+	newBareRepo(t, root)
+	repo := filepath.Join(root, "repo.git")
+	for _, args := range [][]string{
+		{"-C", repo, "branch", "v1.0.0", "main"},
+		{"-C", repo, "tag", "v1.1.0", "main"},
+		{"-C", repo, "-c", "user.name=test", "-c", "user.email=test@example.com", "tag", "-a", "-m", "release", "v1.2.0", "main"},
+		// tag with the same name as the branch
+		{"-C", repo, "tag", "v1.0.0", "main"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+	srv := newGitHTTPServer(t, root, "user", "s3cr3t")
+	// test server uses self signed certificate
+	t.Setenv("GIT_SSL_NO_VERIFY", "true")
+	base := strings.Replace(srv.URL, "https://", "https://user:s3cr3t@", 1) + "/repo.git//base?ref="
+
+	dir := t.TempDir()
+	k := "resources:\n" +
+		"  - " + base + "v1.1.0\n" +
+		"  - " + base + "v1.2.0\n" +
+		"  - " + base + "7f0d7ad4ef2dbfc7ffd1c5b0a6e4e0c1d2f5ba2c\n" +
+		"  - " + base + "v1.0.0\n" +
+		"  - " + base + "v2.0.0\n"
+	kFile := filepath.Join(dir, "kustomization.yaml")
+	if err := os.WriteFile(kFile, []byte(k), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	wantErrMsg := `remote base ref must be a tag or full commit SHA: path=` + kFile + ` line=5 url=` + base + `v1.0.0 err:ref is a branch
+path=` + kFile + ` line=6 url=` + base + `v2.0.0 err:tag not found`
+	err := verifyPinnedRefTags(context.Background(), []string{kFile}, []string{"GIT_TERMINAL_PROMPT=0"})
+	if err == nil || err.Error() != wantErrMsg {
+		t.Errorf("verifyPinnedRefTags() error = %v, want %s", err, wantErrMsg)
+	}
+}
+
+func Test_ensureBuildPinnedRefs(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app")
+	if out, err := exec.Command("cp", "-r", "./testData/app-with-remote-base", dir).CombinedOutput(); err != nil {
+		t.Fatalf("%s", out)
+	}
+
+	app := applicationInfo{name: "app-foo", destinationNamespace: "foo", requirePinnedRefs: true}
+	_, err := ensureBuild(context.Background(), dir, "", "", app)
+	if err == nil || !strings.Contains(err.Error(), "url=ssh://github.com/org/repo1//manifests/lab-foo?ref=master") {
+		t.Errorf("ensureBuild() should reject branch ref got:%v", err)
+	}
+}
+
+func Test_requirePinnedRefs(t *testing.T) {
+	tests := []struct {
+		name      string
+		serverEnv string
+		appEnv    string
+		params    string
+		want      bool
+	}{
+		{"disabled-by-default", "", "", "", false},
+		{"server-default", "true", "", "", true},
+		{"app-env-override", "true", "false", "", false},
+		{"app-param-override", "", "", `[{"name":"require-pinned-refs","string":"true"}]`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ARGOCD_APP_NAME", "foo")
+			t.Setenv("ARGOCD_APP_NAMESPACE", "bar")
+			t.Setenv("ARGOCD_APP_PARAMETERS", tt.params)
+			t.Setenv("AVP_REQUIRE_PINNED_REFS", tt.serverEnv)
+			t.Setenv("ARGOCD_ENV_REQUIRE_PINNED_REFS", tt.appEnv)
+
+			var got bool
+			app := &cli.App{
+				Commands: []*cli.Command{{
+					Name:  "test",
+					Flags: flags,
+					Action: func(c *cli.Context) error {
+						if err := applyAppParameters(c); err != nil {
+							return err
+						}
+						got = requirePinnedRefs(c)
+						return nil
+					},
+				}},
+			}
+			if err := app.Run([]string{"plugin", "test"}); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("requirePinnedRefs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	gitConfigRemoteBaseCacheFragment = `[url "file://%s"]
+	insteadOf = %s
+[protocol "file"]
+	allow = always
+`
+	// remoteBaseCacheHeadRef is used to cache default branch of the remote base without ref
+	remoteBaseCacheHeadRef = "refs/heads/argocd-voodoobox-head"
+)
+
+var (
+	// remoteBaseCacheDir is the dir shared by all the builds to cache remote bases, cache is disabled if empty
+	remoteBaseCacheDir string
+	// remoteBaseCacheTTL is the duration after which unused cached remote base is evicted
+	remoteBaseCacheTTL = 24 * time.Hour
+	// remoteBaseCacheMaxSize is the max total size of the cache in bytes, least recently used
+	// remote bases are evicted once max size is reached
+	remoteBaseCacheMaxSize int64 = 5 << 30
+)
+
+// remoteBaseCache is the bare repository of the remote base shared by all the builds
+// each remote base is cached in `<key>.git` dir along with `<key>.json` metadata file.
+// `<key>.fetch` lock is held exclusively while repository is updated and `<key>.use`
+// lock is shared by all the builds using the repository and prevents eviction.
+type remoteBaseCache struct {
+	url       string
+	dir       string
+	fetchLock *os.File
+	useLock   *os.File
+}
+
+// remoteBaseCacheMeta is stored in `<key>.json` and used for eviction
+type remoteBaseCacheMeta struct {
+	URL      string    `json:"url"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// remoteBaseCloneURL returns URL of the repository and ref of the remote base
+// the same way kustomize does, so that repository fetched by kustomize can be
+// redirected to the cache
+func remoteBaseCloneURL(u string) (string, string, bool) {
+	ref := remoteBaseRef(u)
+	u, _, _ = strings.Cut(u, "?")
+	u = strings.TrimPrefix(u, "git::")
+
+	// host part includes scheme and user i.e. `https://github.com/` or `git@github.com:`
+	var host, repoPath string
+	switch {
+	case strings.HasPrefix(u, "file://"):
+		return "", "", false
+	case strings.Contains(u, "://"):
+		scheme, rest, _ := strings.Cut(u, "://")
+		h, p, ok := strings.Cut(rest, "/")
+		if !ok {
+			return "", "", false
+		}
+		host, repoPath = scheme+"://"+h+"/", p
+	case reSCPLikeURL.MatchString(u):
+		h, p, _ := strings.Cut(u, ":")
+		host, repoPath = h+":", p
+	default:
+		// kustomize defaults to https for URLs without scheme
+		h, p, ok := strings.Cut(u, "/")
+		if !ok {
+			return "", "", false
+		}
+		host, repoPath = "https://"+h+"/", p
+	}
+
+	switch {
+	case strings.Contains(repoPath, "//"):
+		repoPath, _, _ = strings.Cut(repoPath, "//")
+	case strings.Contains(repoPath+"/", ".git/"):
+		i := strings.Index(repoPath+"/", ".git/")
+		repoPath = repoPath[:i+len(".git")]
+	default:
+		// kustomize uses first 2 path segments i.e. `org/repo` as repository
+		segments := strings.SplitN(repoPath, "/", 3)
+		if len(segments) < 2 {
+			return "", "", false
+		}
+		repoPath = segments[0] + "/" + segments[1]
+	}
+	if repoPath == "" {
+		return "", "", false
+	}
+	return host + repoPath, ref, true
+}
+
+// remoteBaseCacheRefs returns clone URL and refs of all remote bases of given kustomization files
+func remoteBaseCacheRefs(kFiles []string) (map[string][]string, error) {
+	remoteRefs, err := kustomizationRemoteRefs(kFiles)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string][]string)
+	for _, r := range remoteRefs {
+		if r.field == "helmCharts" {
+			continue
+		}
+		cloneURL, ref, ok := remoteBaseCloneURL(r.node.Value)
+		if ok && !slices.Contains(refs[cloneURL], ref) {
+			refs[cloneURL] = append(refs[cloneURL], ref)
+		}
+	}
+	return refs, nil
+}
+
+// setupRemoteBaseCache fetches remote bases of given kustomization files to the cache and
+// configures git to fetch them from the cache during build. remote bases are fetched
+// using git env of the build and cached remote base is only used once access to the
+// repository is verified by `git ls-remote`. it returns function which must be called
+// once build is done to release the cache.
+func setupRemoteBaseCache(ctx context.Context, cwd string, kFiles []string, env []string) (func(), error) {
+	release := func() {}
+	if remoteBaseCacheDir == "" {
+		return release, nil
+	}
+
+	refs, err := remoteBaseCacheRefs(kFiles)
+	if err != nil {
+		return release, err
+	}
+	if len(refs) == 0 {
+		return release, nil
+	}
+	if err := os.MkdirAll(remoteBaseCacheDir, 0700); err != nil {
+		return release, fmt.Errorf("unable to create remote base cache dir err:%s", err)
+	}
+
+	var caches []*remoteBaseCache
+	release = func() {
+		for _, c := range caches {
+			c.useLock.Close()
+		}
+		evictRemoteBaseCache(time.Now())
+	}
+
+	urls := make([]string, 0, len(refs))
+	for u := range refs {
+		urls = append(urls, u)
+	}
+	slices.Sort(urls)
+
+	var config strings.Builder
+	for _, u := range urls {
+		c, err := openRemoteBaseCache(u)
+		if err != nil {
+			release()
+			return func() {}, err
+		}
+		err = c.fetch(ctx, refs[u], env)
+		c.fetchLock.Close()
+		if err != nil {
+			// kustomize will fetch remote base directly
+			logger.Warn("unable to cache remote base", "url", u, "err", err)
+			c.useLock.Close()
+			continue
+		}
+		caches = append(caches, c)
+
+		includeFile := filepath.Join(cwd, ".remote-base-cache-"+filepath.Base(c.dir)+".gitconfig")
+		if err := os.WriteFile(includeFile, []byte(fmt.Sprintf(gitConfigRemoteBaseCacheFragment, c.dir, u)), 0600); err != nil {
+			release()
+			return func() {}, fmt.Errorf("unable to write remote base cache git config err:%s", err)
+		}
+		fmt.Fprintf(&config, gitConfigIncludeIfFragment, escapeGlob(u), includeFile)
+	}
+
+	if err := appendGitConfig(cwd, config.String()); err != nil {
+		release()
+		return func() {}, err
+	}
+	return release, nil
+}
+
+// openRemoteBaseCache returns cache of given URL with shared use lock and exclusive
+// fetch lock, cache repository is created if it doesn't exist
+func openRemoteBaseCache(u string) (*remoteBaseCache, error) {
+	sum := sha256.Sum256([]byte(u))
+	key := filepath.Join(remoteBaseCacheDir, hex.EncodeToString(sum[:]))
+	c := &remoteBaseCache{url: u, dir: key + ".git"}
+
+	var err error
+	if c.useLock, err = lockFile(key+".use", syscall.LOCK_SH); err != nil {
+		return nil, err
+	}
+	if c.fetchLock, err = lockFile(key+".fetch", syscall.LOCK_EX); err != nil {
+		c.useLock.Close()
+		return nil, err
+	}
+
+	if fileExists(c.dir) {
+		return c, nil
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "--bare", c.dir},
+		{"-C", c.dir, "remote", "add", "origin", u},
+		// refs are only cached by name so commits need to be fetched by SHA
+		{"-C", c.dir, "config", "uploadpack.allowAnySHA1InWant", "true"},
+	} {
+		if _, err := runGit(context.Background(), nil, args...); err != nil {
+			os.RemoveAll(c.dir)
+			c.fetchLock.Close()
+			c.useLock.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// lockFile opens and locks given file, lock files are never removed
+// so that all builds always lock the same file
+func lockFile(path string, how int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open remote base cache lock err:%s", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to lock remote base cache: path=%s err:%s", path, err)
+	}
+	return f, nil
+}
+
+// fetch verifies access to the repository and fetches given refs if cached refs are outdated
+func (c *remoteBaseCache) fetch(ctx context.Context, refs []string, env []string) error {
+	for _, ref := range refs {
+		if reCommitSHA.MatchString(ref) {
+			// SHA can't be looked up so only access to the repository is verified
+			if _, err := runGit(ctx, env, "-C", c.dir, "ls-remote", "origin", "HEAD"); err != nil {
+				return err
+			}
+			if _, err := runGit(ctx, nil, "-C", c.dir, "cat-file", "-e", ref+"^{commit}"); err == nil {
+				continue
+			}
+			if err := c.fetchRef(ctx, env, ref, "refs/cache/"+ref); err != nil {
+				return err
+			}
+			continue
+		}
+
+		remoteRef, cacheRef := ref, "refs/heads/"+ref
+		switch {
+		case ref == "":
+			remoteRef, cacheRef = "HEAD", remoteBaseCacheHeadRef
+		case strings.HasPrefix(ref, "refs/"):
+			cacheRef = ref
+		}
+		out, err := runGit(ctx, env, "-C", c.dir, "ls-remote", "origin", remoteRef)
+		if err != nil {
+			return err
+		}
+		sha := lsRemoteSHA(out, remoteRef)
+		if sha == "" {
+			return fmt.Errorf("ref not found: ref=%s", remoteRef)
+		}
+		if cached, err := runGit(ctx, nil, "-C", c.dir, "rev-parse", "--verify", "-q", cacheRef); err == nil && strings.TrimSpace(cached) == sha {
+			continue
+		}
+		if err := c.fetchRef(ctx, env, remoteRef, cacheRef); err != nil {
+			return err
+		}
+		if ref == "" {
+			if _, err := runGit(ctx, nil, "-C", c.dir, "symbolic-ref", "HEAD", cacheRef); err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.writeMeta()
+}
+
+func (c *remoteBaseCache) fetchRef(ctx context.Context, env []string, remoteRef, cacheRef string) error {
+	if _, err := runGit(ctx, env, "-C", c.dir, "fetch", "-q", "--depth=1", "origin", remoteRef); err != nil {
+		return err
+	}
+	_, err := runGit(ctx, nil, "-C", c.dir, "update-ref", cacheRef, "FETCH_HEAD")
+	return err
+}
+
+func (c *remoteBaseCache) writeMeta() error {
+	var size int64
+	filepath.WalkDir(c.dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	data, err := json.Marshal(remoteBaseCacheMeta{URL: c.url, Size: size, LastUsed: time.Now()})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(strings.TrimSuffix(c.dir, ".git")+".json", data, 0600)
+}
+
+// lsRemoteSHA returns SHA of the ref from `git ls-remote` output, since ls-remote
+// matches ref suffix the ref is selected in the same order as git resolves ref names
+func lsRemoteSHA(out, ref string) string {
+	shas := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		sha, name, ok := strings.Cut(line, "\t")
+		if ok {
+			shas[name] = sha
+		}
+	}
+	for _, name := range []string{ref, "refs/" + ref, "refs/tags/" + ref, "refs/heads/" + ref} {
+		if sha, ok := shas[name]; ok {
+			return sha
+		}
+	}
+	return ""
+}
+
+// evictRemoteBaseCache removes remote bases which are not used for TTL and least recently
+// used remote bases if cache is over the max size. remote bases used by builds are skipped.
+func evictRemoteBaseCache(now time.Time) {
+	metaFiles, err := filepath.Glob(filepath.Join(remoteBaseCacheDir, "*.json"))
+	if err != nil {
+		return
+	}
+
+	type entry struct {
+		key  string
+		meta remoteBaseCacheMeta
+	}
+	var entries []entry
+	var total int64
+	for _, f := range metaFiles {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var m remoteBaseCacheMeta
+		if err := json.Unmarshal(data, &m); err != nil {
+			continue
+		}
+		entries = append(entries, entry{strings.TrimSuffix(f, ".json"), m})
+		total += m.Size
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return a.meta.LastUsed.Compare(b.meta.LastUsed) })
+
+	for _, e := range entries {
+		if now.Sub(e.meta.LastUsed) < remoteBaseCacheTTL && total <= remoteBaseCacheMaxSize {
+			continue
+		}
+		if removeRemoteBaseCache(e.key) {
+			logger.Info("evicted remote base from cache", "url", e.meta.URL, "last-used", e.meta.LastUsed)
+			total -= e.meta.Size
+		}
+	}
+}
+
+// removeRemoteBaseCache removes cached remote base if its not used by any build
+func removeRemoteBaseCache(key string) bool {
+	for _, l := range []string{key + ".use", key + ".fetch"} {
+		lock, err := lockFile(l, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			return false
+		}
+		defer lock.Close()
+	}
+	os.Remove(key + ".json")
+	return os.RemoveAll(key+".git") == nil
+}
+
+// runGit runs git command with given env added to the process env
+func runGit(ctx context.Context, env []string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to run git: args=%s err:%s stderr:%s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// escapeGlob escapes special characters of the git config glob
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
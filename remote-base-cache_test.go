@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_remoteBaseCloneURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    string
+		wantRef string
+		wantOK  bool
+	}{
+		{"https://github.com/org/repo//manifests?ref=v1.2.3", "https://github.com/org/repo", "v1.2.3", true},
+		{"https://github.com/org/repo.git/manifests/base?ref=main", "https://github.com/org/repo.git", "main", true},
+		{"https://github.com/org/repo/manifests/base", "https://github.com/org/repo", "", true},
+		{"ssh://git@github.com/org/repo1//manifests/lab-foo?ref=master", "ssh://git@github.com/org/repo1", "master", true},
+		{"git@github.com:org/repo.git//base?version=v1", "git@github.com:org/repo.git", "v1", true},
+		{"git::https://gitlab.io/org/repo//base", "https://gitlab.io/org/repo", "", true},
+		{"github.com/org/open1//manifests/lab-foo?ref=master", "https://github.com/org/open1", "master", true},
+		{"https://github.com/org", "", "", false},
+		{"file:///tmp/repo//base", "", "", false},
+	}
+	for _, tt := range tests {
+		got, ref, ok := remoteBaseCloneURL(tt.url)
+		if got != tt.want || ref != tt.wantRef || ok != tt.wantOK {
+			t.Errorf("remoteBaseCloneURL(%s) = %s, %s, %v, want %s, %s, %v", tt.url, got, ref, ok, tt.want, tt.wantRef, tt.wantOK)
+		}
+	}
+}
+
+func Test_lsRemoteSHA(t *testing.T) {
+	out := "1111111111111111111111111111111111111111\trefs/heads/v1\n" +
+		"2222222222222222222222222222222222222222\trefs/tags/v1\n" +
+		"3333333333333333333333333333333333333333\trefs/heads/main\n" +
+		"4444444444444444444444444444444444444444\tHEAD\n"
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"v1", "2222222222222222222222222222222222222222"},
+		{"main", "3333333333333333333333333333333333333333"},
+		{"HEAD", "4444444444444444444444444444444444444444"},
+		{"refs/heads/v1", "1111111111111111111111111111111111111111"},
+		{"dev", ""},
+	}
+	for _, tt := range tests {
+		if got := lsRemoteSHA(out, tt.ref); got != tt.want {
+			t.Errorf("lsRemoteSHA(%s) = %s, want %s", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func Test_remoteBaseCacheBuild(t *testing.T) {
+	root := t.TempDir()
+	newBareRepo(t, root)
+	srv := newGitHTTPServer(t, root, "user", "s3cr3t")
+	host := strings.TrimPrefix(srv.URL, "https://")
+	// test server uses self signed certificate
+	t.Setenv("GIT_SSL_NO_VERIFY", "true")
+
+	remoteBaseCacheDir = t.TempDir()
+	defer func() { remoteBaseCacheDir = "" }()
+
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-https", Namespace: "foo"},
+			Data:       map[string][]byte{host: []byte("user:s3cr3t")},
+		},
+	)
+	app := applicationInfo{name: "foo", destinationNamespace: "foo", gitHTTPSSecret: secretInfo{name: "argocd-voodoobox-git-https"}}
+
+	newApp := func(t *testing.T, ref string) string {
+		dir := t.TempDir()
+		k := "resources:\n  - " + srv.URL + "/repo.git//base" + ref + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(k), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	build := func(t *testing.T, dir string, app applicationInfo, want string) {
+		t.Helper()
+		got, err := ensureBuild(context.Background(), dir, "", "", app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), want) {
+			t.Errorf("output should contain %q\n%s", want, got)
+		}
+		config, err := os.ReadFile(filepath.Join(dir, ".gitconfig"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(config), "hasconfig:remote.*.url:"+srv.URL+"/repo.git") {
+			t.Errorf("remote base should be fetched from cache\n%s", config)
+		}
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		build(t, newApp(t, "?ref=main"), app, "name: remote-base")
+		build(t, newApp(t, ""), app, "name: remote-base")
+
+		metaFiles, _ := filepath.Glob(filepath.Join(remoteBaseCacheDir, "*.json"))
+		if len(metaFiles) != 1 {
+			t.Fatalf("remote base should be cached once got:%v", metaFiles)
+		}
+		data, err := os.ReadFile(metaFiles[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta remoteBaseCacheMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			t.Fatal(err)
+		}
+		if meta.URL != srv.URL+"/repo.git" || meta.Size == 0 {
+			t.Errorf("unexpected cache meta %+v", meta)
+		}
+	})
+
+	// new commit on the branch is fetched to the cache
+	work := t.TempDir()
+	for _, args := range [][]string{
+		{"clone", "-q", filepath.Join(root, "repo.git"), work},
+		{"-C", work, "mv", "base/configmap.yaml", "base/cm.yaml"},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "rename"},
+		{"-C", work, "push", "-q", "origin", "main"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(work, "base", "kustomization.yaml"), []byte("resources:\n  - cm.yaml\nnamePrefix: new-\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-a", "-m", "prefix"},
+		{"-C", work, "push", "-q", "origin", "main"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+	sha, err := exec.Command("git", "-C", work, "rev-parse", "HEAD~2").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("updated-branch", func(t *testing.T) {
+		build(t, newApp(t, "?ref=main"), app, "name: new-remote-base")
+	})
+
+	t.Run("commit-sha", func(t *testing.T) {
+		got, err := ensureBuild(context.Background(), newApp(t, "?ref="+strings.TrimSpace(string(sha))), "", "", app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), "name: remote-base") || strings.Contains(string(got), "new-remote-base") {
+			t.Errorf("output should be built from given commit\n%s", got)
+		}
+	})
+
+	// cached remote base is not used by apps without access to the repository
+	t.Run("without-credentials", func(t *testing.T) {
+		app := applicationInfo{name: "bar", destinationNamespace: "foo"}
+		if _, err := ensureBuild(context.Background(), newApp(t, "?ref=main"), "", "", app); err == nil {
+			t.Error("build should fail without credentials")
+		}
+	})
+}
+
+func Test_evictRemoteBaseCache(t *testing.T) {
+	remoteBaseCacheDir = t.TempDir()
+	defer func() { remoteBaseCacheDir = "" }()
+	defer func(ttl time.Duration, size int64) {
+		remoteBaseCacheTTL, remoteBaseCacheMaxSize = ttl, size
+	}(remoteBaseCacheTTL, remoteBaseCacheMaxSize)
+	remoteBaseCacheTTL, remoteBaseCacheMaxSize = time.Hour, 250
+
+	now := time.Now()
+	entries := map[string]remoteBaseCacheMeta{
+		"expired":        {URL: "https://github.com/org/expired", Size: 10, LastUsed: now.Add(-2 * time.Hour)},
+		"expired-in-use": {URL: "https://github.com/org/expired-in-use", Size: 10, LastUsed: now.Add(-2 * time.Hour)},
+		"oldest":         {URL: "https://github.com/org/oldest", Size: 100, LastUsed: now.Add(-30 * time.Minute)},
+		"older":          {URL: "https://github.com/org/older", Size: 100, LastUsed: now.Add(-20 * time.Minute)},
+		"recent":         {URL: "https://github.com/org/recent", Size: 100, LastUsed: now.Add(-10 * time.Minute)},
+	}
+	for key, meta := range entries {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key = filepath.Join(remoteBaseCacheDir, key)
+		if err := os.Mkdir(key+".git", 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(key+".json", data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock, err := lockFile(filepath.Join(remoteBaseCacheDir, "expired-in-use.use"), syscall.LOCK_SH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	evictRemoteBaseCache(now)
+
+	for key, wantExists := range map[string]bool{
+		"expired":        false,
+		"expired-in-use": true,
+		"oldest":         false,
+		"older":          true,
+		"recent":         true,
+	} {
+		if exists := fileExists(filepath.Join(remoteBaseCacheDir, key+".git")); exists != wantExists {
+			t.Errorf("key=%s exists=%v want=%v", key, exists, wantExists)
+		}
+	}
+}
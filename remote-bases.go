@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	remoteBasesGitConfigFilename = ".remote-bases.gitconfig"
+
+	// all git transports are disabled and only enabled for the remotes matching the allowlist
+	gitConfigProtocolFragment = `[protocol]
+	allow = %s
+`
+	gitConfigAllowedProtocolsFragment = `[protocol "https"]
+	allow = always
+[protocol "ssh"]
+	allow = always
+`
+	// ssh config uses hostname after `HostName` substitution so hosts aliased with key names are also checked
+	sshDisallowedHostsFragment = `Match host *,%s
+    ProxyCommand sh -c "echo 'remote host is not allowed: host=%%h' >&2; exit 1"
+`
+)
+
+// allowedRemoteBases is the server level allowlist of remote bases,
+// if its empty remote bases are not restricted
+var allowedRemoteBases []remoteBasePrefix
+
+var reSCPLikeURL = regexp.MustCompile(`^\w[\w.-]*@[^/:]+:`)
+
+// remoteBasePrefix is the host and optional repository path prefix of allowed remote bases
+type remoteBasePrefix struct {
+	host string
+	path string
+}
+
+// parseAllowedRemoteBases parses comma-separated list of allowed hosts or
+// repository prefixes i.e. `github.com/org,gitlab.com/org/repo,bitbucket.org`
+func parseAllowedRemoteBases(v string) ([]remoteBasePrefix, error) {
+	var prefixes []remoteBasePrefix
+	for _, e := range strings.Split(v, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		host, repoPath := splitRemoteURL(e)
+		if host == "" || strings.ContainsAny(e, `*?[]\`) {
+			return nil, fmt.Errorf("invalid allowed remote base: %s", e)
+		}
+		prefixes = append(prefixes, remoteBasePrefix{host: host, path: repoPath})
+	}
+	return prefixes, nil
+}
+
+// splitRemoteURL returns domain and repository path of remote URL without scheme, user, port and query
+// i.e. `https://github.com/org/repo//path?ref=v1` and `git@github.com:org/repo//path` returns
+// `github.com` and `org/repo//path`.
+func splitRemoteURL(u string) (string, string) {
+	u, _, _ = strings.Cut(u, "?")
+	u = strings.TrimPrefix(u, "git::")
+
+	p := u
+	if _, rest, ok := strings.Cut(u, "://"); ok {
+		p = rest
+	}
+	scpLike := p == u
+	if i := strings.Index(p, "@"); i >= 0 && i < strings.IndexAny(p+"/", "/:") {
+		p = p[i+1:]
+	}
+
+	var host, repoPath string
+	// scp like syntax i.e. `github.com:org/repo`
+	if scpLike && strings.Index(p+":", ":") < strings.Index(p+"/", "/") {
+		host, repoPath, _ = strings.Cut(p, ":")
+	} else {
+		host, repoPath, _ = strings.Cut(p, "/")
+		host, _, _ = strings.Cut(host, ":")
+	}
+	return strings.ToLower(host), strings.Trim(repoPath, "/")
+}
+
+// isRemoteRef returns true if kustomization reference of the given dir is not a local path
+func isRemoteRef(dir, ref string) bool {
+	switch {
+	case strings.HasPrefix(ref, "file://"):
+		return false
+	case strings.Contains(ref, "://"), strings.HasPrefix(ref, "git::"), reSCPLikeURL.MatchString(ref):
+		return true
+	case fileExists(filepath.Join(dir, ref)):
+		return false
+	}
+	// kustomize also supports URLs without scheme i.e. `github.com/org/repo//path`
+	host, _, _ := strings.Cut(ref, "/")
+	return strings.Contains(host, ".") && !strings.HasPrefix(host, ".")
+}
+
+// remoteBaseAllowed returns true if remote URL matches any of the allowed prefixes,
+// repository path prefix only matches whole path segments
+func remoteBaseAllowed(u string, allowed []remoteBasePrefix) bool {
+	host, repoPath := splitRemoteURL(u)
+	for _, a := range allowed {
+		if host != a.host {
+			continue
+		}
+		if a.path == "" || repoPath == a.path || repoPath == a.path+".git" ||
+			strings.HasPrefix(repoPath, a.path+"/") || strings.HasPrefix(repoPath, a.path+".git/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRemoteBases returns error naming all remote references of given
+// kustomization files which are not allowed by the allowlist
+func checkRemoteBases(kFiles []string, allowed []remoteBasePrefix) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	refs, err := kustomizationRemoteRefs(kFiles)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, r := range refs {
+		if !remoteBaseAllowed(r.node.Value, allowed) {
+			errs = append(errs, fmt.Errorf("path=%s line=%d url=%s", r.path, r.node.Line, r.node.Value))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("remote base is not allowed: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// writeRemoteBasesGitConfig disables all git transports and only enables https and ssh
+// for the remotes matching the allowlist, since kustomize adds remote before fetching
+// repository, it also restricts remote bases referenced by other remote bases.
+func writeRemoteBasesGitConfig(cwd string, allowed []remoteBasePrefix) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	includeFile := filepath.Join(cwd, remoteBasesGitConfigFilename)
+	if err := os.WriteFile(includeFile, []byte(gitConfigAllowedProtocolsFragment), 0600); err != nil {
+		return fmt.Errorf("unable to write remote bases git config err:%s", err)
+	}
+
+	var config strings.Builder
+	fmt.Fprintf(&config, gitConfigProtocolFragment, "never")
+	for _, a := range allowed {
+		for _, g := range a.urlGlobs() {
+			fmt.Fprintf(&config, gitConfigIncludeIfFragment, g, includeFile)
+		}
+	}
+	return appendGitConfig(cwd, config.String())
+}
+
+// urlGlobs returns globs matching https and ssh URLs of the prefix. ssh URLs
+// with domain replaced by the key name i.e. `key_a_github_com` are also matched
+func (a remoteBasePrefix) urlGlobs() []string {
+	paths := repoPathGlobs(a.path)
+
+	globs := sshURLGlobs(a.host, paths)
+	globs = append(globs, sshURLGlobs("*_"+strings.ReplaceAll(a.host, ".", "_"), paths)...)
+	for _, p := range paths {
+		globs = append(globs, "https://"+a.host+"/"+p, "https://"+a.host+":*/"+p)
+	}
+	return globs
+}
+
+// sshDisallowedHosts returns ssh config fragment which fails connections to the hosts not in the allowlist
+func sshDisallowedHosts(allowed []remoteBasePrefix) string {
+	if len(allowed) == 0 {
+		return ""
+	}
+	var hosts []string
+	for _, a := range allowed {
+		hosts = append(hosts, "!"+a.host)
+	}
+	return fmt.Sprintf(sshDisallowedHostsFragment, strings.Join(hosts, ","))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_splitRemoteURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		wantHost string
+		wantPath string
+	}{
+		{"github.com/org/open1//manifests/lab-foo?ref=master", "github.com", "org/open1//manifests/lab-foo"},
+		{"https://GitHub.com/org/repo.git//base?ref=v1", "github.com", "org/repo.git//base"},
+		{"git::https://github.com/org/repo", "github.com", "org/repo"},
+		{"ssh://git@github.com:22/org/repo", "github.com", "org/repo"},
+		{"ssh://key_a_github_com/org/repo1//manifests", "key_a_github_com", "org/repo1//manifests"},
+		{"git@github.com:org/repo.git//base", "github.com", "org/repo.git//base"},
+		{"github.com", "github.com", ""},
+		{"gitlab.com/org/", "gitlab.com", "org"},
+	}
+	for _, tt := range tests {
+		host, repoPath := splitRemoteURL(tt.url)
+		if host != tt.wantHost || repoPath != tt.wantPath {
+			t.Errorf("splitRemoteURL(%s) = %s, %s, want %s, %s", tt.url, host, repoPath, tt.wantHost, tt.wantPath)
+		}
+	}
+}
+
+func Test_remoteBaseAllowed(t *testing.T) {
+	allowed, err := parseAllowedRemoteBases("github.com/org/repo1, gitlab.io,ssh://git@bitbucket.org/team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"ssh://github.com/org/repo1//manifests?ref=master", true},
+		{"https://github.com/org/repo1.git//manifests", true},
+		{"git@github.com:org/repo1", true},
+		{"https://github.com/org/repo10//manifests", false},
+		{"https://github.com/other/repo1", false},
+		{"ssh://gitlab.io/any/repo", true},
+		{"https://bitbucket.org/team/repo", true},
+		{"https://evil.com/org/repo1", false},
+	}
+	for _, tt := range tests {
+		if got := remoteBaseAllowed(tt.url, allowed); got != tt.want {
+			t.Errorf("remoteBaseAllowed(%s) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+
+	if _, err := parseAllowedRemoteBases("github.com/org/*"); err == nil {
+		t.Error("glob should not be allowed")
+	}
+}
+
+func Test_checkRemoteBases(t *testing.T) {
+	kFiles, err := findKustomizeFiles("testData/app-with-remote-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkRemoteBases(kFiles, nil); err != nil {
+		t.Errorf("remote bases should not be restricted without allowlist err:%s", err)
+	}
+
+	allowed, err := parseAllowedRemoteBases("github.com/org/open1,github.com/org/repo1,gitlab.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantErrMsg := `remote base is not allowed: path=testData/app-with-remote-base/app/kustomization.yml line=7 url=ssh://github.com/org/repo5//manifests/foo?ref=master
+path=testData/app-with-remote-base/kustomization.yaml line=10 url=ssh://github.com/org/repo3//manifests/lab-zoo?ref=dev
+path=testData/app-with-remote-base/kustomization.yaml line=14 url=ssh://bitbucket.org/org/repo3//manifests/lab-zoo?ref=dev`
+	err = checkRemoteBases(kFiles, allowed)
+	if err == nil || err.Error() != wantErrMsg {
+		t.Errorf("checkRemoteBases() error = %v, want %s", err, wantErrMsg)
+	}
+}
+
+func Test_writeRemoteBasesGitConfig(t *testing.T) {
+	allowed, err := parseAllowedRemoteBases("github.com/org/repo1,gitlab.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd := t.TempDir()
+	if err := writeRemoteBasesGitConfig(cwd, allowed); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/org/repo1", "always"},
+		{"https://github.com/org/repo1.git", "always"},
+		{"ssh://git@github.com/org/repo1/sub", "always"},
+		{"ssh://key_a_github_com/org/repo1", "always"},
+		{"git@gitlab.io:team/repo", "always"},
+		{"https://github.com/org/repo10", "never"},
+		{"http://github.com/org/repo1", "never"},
+		{"https://evil.com/org/repo1", "never"},
+	}
+	for _, tt := range tests {
+		repo := t.TempDir()
+		for _, args := range [][]string{{"init", "-q"}, {"remote", "add", "origin", tt.url}} {
+			git(t, cwd, repo, args...)
+		}
+		scheme, _, ok := strings.Cut(tt.url, "://")
+		if !ok {
+			scheme = "ssh"
+		}
+		got := git(t, cwd, repo, "config", "--default", "never", "protocol."+scheme+".allow")
+		if got != tt.want {
+			t.Errorf("url=%s protocol.%s.allow got=%s want=%s", tt.url, scheme, got, tt.want)
+		}
+	}
+}
+
+func Test_allowedRemoteBasesBuild(t *testing.T) {
+	root := t.TempDir()
+	newBareRepo(t, root)
+	srv := newGitHTTPServer(t, root, "user", "s3cr3t")
+	host := strings.TrimPrefix(srv.URL, "https://")
+	// nested remote base references repo.git
+	newBareRepoWithFiles(t, root, "nested.git", map[string]string{
+		"base/kustomization.yaml": "resources:\n  - " + srv.URL + "/repo.git//base?ref=main\n",
+	})
+	// test server uses self signed certificate
+	t.Setenv("GIT_SSL_NO_VERIFY", "true")
+
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-https", Namespace: "foo"},
+			Data:       map[string][]byte{host: []byte("user:s3cr3t")},
+		},
+	)
+	app := applicationInfo{name: "foo", destinationNamespace: "foo", gitHTTPSSecret: secretInfo{name: "argocd-voodoobox-git-https"}}
+
+	newApp := func(t *testing.T) string {
+		dir := t.TempDir()
+		k := "resources:\n  - " + srv.URL + "/nested.git//base?ref=main\n"
+		if err := os.WriteFile(filepath.Join(dir, "kustomization.yaml"), []byte(k), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	tests := []struct {
+		name       string
+		allowed    string
+		wantErrMsg string
+	}{
+		{"allowed", "127.0.0.1/nested,127.0.0.1/repo", ""},
+		{"allowed-host", "127.0.0.1", ""},
+		{"not-allowed", "127.0.0.1/repo", "url=" + srv.URL + "/nested.git//base?ref=main"},
+		{"nested-not-allowed", "127.0.0.1/nested", "transport 'https' not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := parseAllowedRemoteBases(tt.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowedRemoteBases = allowed
+			defer func() { allowedRemoteBases = nil }()
+
+			got, err := ensureBuild(context.Background(), newApp(t), "", "", app)
+			if tt.wantErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Fatalf("ensureBuild() error = %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(got), "name: remote-base") {
+				t.Errorf("remote base resources missing from output\n%s", got)
+			}
+		})
+	}
+}
+
+func Test_sshDisallowedHosts(t *testing.T) {
+	allowed, err := parseAllowedRemoteBases("github.com/org/repo1,gitlab.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := constructSSHConfig(map[string]string{"key_a": "path/to/key_a"}, nil, map[string]string{"key_a": "github.com"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(config, append(body, []byte("\n"+sshDisallowedHosts(allowed))...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for host, wantDenied := range map[string]bool{"key_a_github_com": false, "gitlab.io": false, "evil.com": true} {
+		out, err := exec.Command("ssh", "-G", "-F", config, host).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if denied := strings.Contains(string(out), "remote host is not allowed"); denied != wantDenied {
+			t.Errorf("host=%s denied=%v want=%v", host, denied, wantDenied)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// repoMapKey is the optional key of git ssh secret containing mapping of
+// remote repositories to the ssh keys of the secret
+const repoMapKey = "repo_map"
+
+const (
+	gitConfigIncludeIfFragment = `[includeIf "hasconfig:remote.*.url:%s"]
+	path = %s
+`
+	gitConfigInsteadOfFragment = `[url "%s"]
+	insteadOf = %s
+`
+)
+
+// repoMapEntry maps remote repositories matching the pattern to the key of git ssh secret
+type repoMapEntry struct {
+	// host is the domain of the repositories
+	host string
+	// path is either the prefix or the glob pattern of the repository path
+	path string
+	key  string
+}
+
+// parseRepoMap parses `repo_map` of git ssh secret. each line contains repository
+// pattern and the key name separated by space, empty lines and comments are ignored.
+// pattern is a repository URL prefix or a glob i.e. `github.com/org/repo1`, `github.com/org/*-infra`
+// or `github.com`, scheme and user are optional so `ssh://git@github.com/org` and
+// `git@github.com:org` are valid patterns too.
+func parseRepoMap(data []byte) ([]repoMapEntry, error) {
+	var entries []repoMapEntry
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line should contain repository pattern and key name: line=%d", n)
+		}
+
+		host, repoPath := splitRemoteURL(fields[0])
+		if host == "" || strings.ContainsAny(host, `*?[]\`) {
+			return nil, fmt.Errorf("repository pattern should start with a domain: line=%d pattern=%s", n, fields[0])
+		}
+		if _, err := path.Match(repoPath, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern: line=%d pattern=%s err:%s", n, fields[0], err)
+		}
+		entries = append(entries, repoMapEntry{host: host, path: repoPath, key: fields[1]})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// repoPathGlobs returns globs matching the repository path of the prefix or
+// the glob pattern. prefix only matches whole path segments.
+func repoPathGlobs(repoPath string) []string {
+	switch {
+	case repoPath == "":
+		// `**` is only special after `/` so it can't be used for scp like syntax
+		return []string{"*", "*/**"}
+	case strings.ContainsAny(repoPath, `*?[`):
+		return []string{repoPath, repoPath + ".git"}
+	default:
+		return []string{repoPath, repoPath + ".git", repoPath + "/**"}
+	}
+}
+
+// sshURLGlobs returns globs matching all the forms of ssh URLs used by kustomize
+func sshURLGlobs(host string, paths []string) []string {
+	var globs []string
+	for _, p := range paths {
+		globs = append(globs,
+			"ssh://"+host+"/"+p,
+			"ssh://"+host+":*/"+p,
+			"ssh://git@"+host+"/"+p,
+			"ssh://git@"+host+":*/"+p,
+			"git@"+host+":"+p,
+		)
+	}
+	return globs
+}
+
+// writeRepoMapGitConfig configures git to replace domain of the remote repository with
+// the ssh config Host of the mapped key. config is conditionally included based on the
+// URL of the remote so that mapping also applies to remote bases referenced by other
+// remote bases. if multiple entries match the same repository first entry is used.
+// if repository also matches the remote base mirror, it is replaced with the mirror
+// host aliased with the key. it returns mirror hosts of the keys which should be added
+// to the ssh config.
+func writeRepoMapGitConfig(cwd, sshDir string, entries []repoMapEntry, mirrors []remoteBaseMirror) ([]repoMapEntry, error) {
+	var hosts []repoMapEntry
+	var config strings.Builder
+	for i, e := range entries {
+		alias := hostAlias(e.key, e.host)
+
+		var include strings.Builder
+		// git uses the longest matching `insteadOf` and on ties the `url` section defined first,
+		// mirror with prefix path is always longer and without it mirror config must be included first
+		for j, m := range mirrors {
+			if m.prefix.host != e.host {
+				continue
+			}
+			mirrorFile := filepath.Join(sshDir, fmt.Sprintf("repo_map_%d_mirror_%d.gitconfig", i, j))
+			if err := os.WriteFile(mirrorFile, []byte(m.sshInsteadOf(e.host, hostAlias(e.key, m.mirror.host))), 0600); err != nil {
+				return nil, fmt.Errorf("unable to write repo map git config err:%s", err)
+			}
+			for _, g := range sshURLGlobs(m.prefix.host, repoPathGlobs(m.prefix.path)) {
+				fmt.Fprintf(&include, gitConfigIncludeIfFragment, g, mirrorFile)
+			}
+			hosts = append(hosts, repoMapEntry{host: m.mirror.host, key: e.key})
+		}
+		fmt.Fprintf(&include, gitConfigInsteadOfFragment, "ssh://git@"+alias+"/", "ssh://"+e.host+"/")
+		fmt.Fprintf(&include, gitConfigInsteadOfFragment, "ssh://git@"+alias+"/", "ssh://git@"+e.host+"/")
+		fmt.Fprintf(&include, gitConfigInsteadOfFragment, "git@"+alias+":", "git@"+e.host+":")
+
+		includeFile := filepath.Join(sshDir, fmt.Sprintf("repo_map_%d.gitconfig", i))
+		if err := os.WriteFile(includeFile, []byte(include.String()), 0600); err != nil {
+			return nil, fmt.Errorf("unable to write repo map git config err:%s", err)
+		}
+		for _, g := range sshURLGlobs(e.host, repoPathGlobs(e.path)) {
+			fmt.Fprintf(&config, gitConfigIncludeIfFragment, g, includeFile)
+		}
+	}
+	return hosts, appendGitConfig(cwd, config.String())
+}
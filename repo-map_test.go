@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_parseRepoMap(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		want       []repoMapEntry
+		wantErrMsg string
+	}{
+		{"all-pattern-forms", `
+# comment
+github.com/org/repo1           key_a
+ssh://git@github.com/org/repo2 key_a
+git@github.com:org/*-infra     sshKeyB
+
+gitlab.io                      sshKeyB
+ssh://bitbucket.org/org/       key_c
+`, []repoMapEntry{
+			{host: "github.com", path: "org/repo1", key: "key_a"},
+			{host: "github.com", path: "org/repo2", key: "key_a"},
+			{host: "github.com", path: "org/*-infra", key: "sshKeyB"},
+			{host: "gitlab.io", path: "", key: "sshKeyB"},
+			{host: "bitbucket.org", path: "org", key: "key_c"},
+		}, ""},
+		{"missing-key", "github.com/org/repo1", nil, "line should contain repository pattern and key name: line=1"},
+		{"glob-in-domain", "\n*.github.com/org key_a", nil, "repository pattern should start with a domain: line=2 pattern=*.github.com/org"},
+		{"invalid-glob", "github.com/org/[repo key_a", nil, "invalid repository pattern: line=1 pattern=github.com/org/[repo err:syntax error in pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRepoMap([]byte(tt.data))
+			if tt.wantErrMsg != "" {
+				if err == nil || err.Error() != tt.wantErrMsg {
+					t.Fatalf("parseRepoMap() error = %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(repoMapEntry{})); diff != "" {
+				t.Errorf("parseRepoMap() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func Test_setupGitSSHRepoMap(t *testing.T) {
+	_, key := generateSSHKey(t)
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-ssh", Namespace: "foo"},
+			Data: map[string][]byte{
+				"key_a":   key,
+				"sshKeyB": key,
+				"repo_map": []byte(`
+github.com/org/repo1     key_a
+github.com/org/*-infra   sshKeyB
+github.com/org           key_a
+gitlab.io                sshKeyB
+`),
+			},
+		},
+	)
+
+	cwd := t.TempDir()
+	app := applicationInfo{
+		name:                 "app-foo",
+		destinationNamespace: "foo",
+		gitSSHSecret:         secretInfo{name: "argocd-voodoobox-git-ssh"},
+	}
+	if _, err := setupGitSSH(context.Background(), cwd, "", "", app); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := os.ReadFile(filepath.Join(cwd, ".ssh", "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"Host key_a_github_com\n", "Host sshKeyB_github_com\n", "Host sshKeyB_gitlab_io\n"} {
+		if strings.Count(string(config), host) != 1 {
+			t.Errorf("ssh config should contain %q once\n%s", host, config)
+		}
+	}
+
+	// remote URLs are resolved by git the same way for the nested remote bases
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"ssh://github.com/org/repo1", "ssh://git@key_a_github_com/org/repo1"},
+		{"ssh://git@github.com/org/repo1.git", "ssh://git@key_a_github_com/org/repo1.git"},
+		{"git@github.com:org/repo1", "git@key_a_github_com:org/repo1"},
+		{"ssh://github.com/org/repo10", "ssh://git@key_a_github_com/org/repo10"},
+		{"ssh://github.com/org/app-infra", "ssh://git@sshKeyB_github_com/org/app-infra"},
+		{"git@gitlab.io:team/repo", "git@sshKeyB_gitlab_io:team/repo"},
+		{"ssh://github.com/other/repo", "ssh://github.com/other/repo"},
+	}
+	for _, tt := range tests {
+		repo := t.TempDir()
+		for _, args := range [][]string{{"init", "-q"}, {"remote", "add", "origin", tt.url}} {
+			git(t, cwd, repo, args...)
+		}
+		if got := git(t, cwd, repo, "remote", "get-url", "origin"); got != tt.want {
+			t.Errorf("url=%s got=%s want=%s", tt.url, got, tt.want)
+		}
+	}
+}
+
+// git runs git command in given dir using gitconfig of the home dir
+func git(t *testing.T, home, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "HOME="+home, "GIT_CONFIG_NOSYSTEM=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s err:%s out:%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
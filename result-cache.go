@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"filippo.io/age"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	// resultCacheDir is the dir where build outputs are cached, cache is disabled if empty
+	resultCacheDir string
+	// resultCacheTTL is the duration after which cached build output is not used
+	resultCacheTTL = 10 * time.Minute
+	// resultCacheIdentity is used to encrypt cached build outputs at rest
+	resultCacheIdentity *age.X25519Identity
+)
+
+// parseResultCacheIdentity reads age identity used to encrypt cached build outputs from the given file
+func parseResultCacheIdentity(path string) (*age.X25519Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read result cache identity err:%s", err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse result cache identity err:%s", err)
+	}
+	identity, ok := identities[0].(*age.X25519Identity)
+	if !ok {
+		return nil, fmt.Errorf("result cache identity should be X25519 age identity")
+	}
+	return identity, nil
+}
+
+// resultCacheKey returns key of the build output of the app. key is derived from the
+// revision and source path of the app along with all the flags (which includes server config
+// and app envs and parameters) and resource versions of the secrets used by the app, so
+// cached output is invalidated when any of the inputs changes. it returns empty key if cache
+// is disabled or revision is not known.
+func resultCacheKey(c *cli.Context, app applicationInfo) (string, error) {
+	revision := c.String("app-revision")
+	if resultCacheDir == "" || revision == "" {
+		return "", nil
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "revision=%s\napp=%s\npath=%s\n", revision, app.name, c.String("app-source-path"))
+	for _, f := range flags {
+		name := f.Names()[0]
+		fmt.Fprintf(h, "flag %s=%v\n", name, c.Value(name))
+	}
+	for _, s := range append(slices.Clone(app.keyringSecrets), app.gitSSHSecret, app.gitHTTPSSecret, app.helmSecret) {
+		if s.name == "" {
+			continue
+		}
+		v, err := secretVersion(c.Context, app, s)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "secret %s/%s=%s\n", s.namespace, s.name, v)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// secretVersion returns resource version of the secret, since local secrets
+// doesn't have resource version hash of the data is used instead
+func secretVersion(ctx context.Context, app applicationInfo, s secretInfo) (string, error) {
+	sec, err := secret(ctx, app, s)
+	if errors.Is(err, errNotFound) {
+		return "not-found", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if sec.ResourceVersion != "" {
+		return sec.ResourceVersion, nil
+	}
+
+	h := sha256.New()
+	keys := make([]string, 0, len(sec.Data))
+	for k := range sec.Data {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%x\n", k, sha256.Sum256(sec.Data[k]))
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readResultCache returns cached build output of the key if its not expired
+func readResultCache(key string) ([]byte, bool) {
+	if key == "" {
+		return nil, false
+	}
+	path := filepath.Join(resultCacheDir, key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if time.Since(info.ModTime()) > resultCacheTTL {
+		os.Remove(path)
+		return nil, false
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	r, err := age.Decrypt(f, resultCacheIdentity)
+	if err != nil {
+		logger.Warn("unable to decrypt cached build output", "key", key, "err", err)
+		return nil, false
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false
+	}
+	// key is encrypted along with the output so that cache files can't be swapped
+	header, manifests, ok := bytes.Cut(data, []byte("\n"))
+	if !ok || string(header) != key {
+		logger.Warn("cached build output doesn't match the key", "key", key)
+		return nil, false
+	}
+	return manifests, true
+}
+
+// writeResultCache encrypts build output and writes it to the cache, cache file is
+// renamed once its written so that concurrent builds never read partial output
+func writeResultCache(key string, manifests []byte) error {
+	if key == "" {
+		return nil
+	}
+	if err := os.MkdirAll(resultCacheDir, 0700); err != nil {
+		return fmt.Errorf("unable to create result cache dir err:%s", err)
+	}
+
+	tmp, err := os.CreateTemp(resultCacheDir, ".tmp-"+key)
+	if err != nil {
+		return fmt.Errorf("unable to create result cache file err:%s", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w, err := age.Encrypt(tmp, resultCacheIdentity.Recipient())
+	if err != nil {
+		return fmt.Errorf("unable to encrypt build output err:%s", err)
+	}
+	if _, err := w.Write(append([]byte(key+"\n"), manifests...)); err != nil {
+		return fmt.Errorf("unable to encrypt build output err:%s", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("unable to encrypt build output err:%s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write result cache file err:%s", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(resultCacheDir, key)); err != nil {
+		return fmt.Errorf("unable to write result cache file err:%s", err)
+	}
+
+	evictResultCache(time.Now())
+	return nil
+}
+
+// evictResultCache removes expired build outputs and temp files left by failed writes
+func evictResultCache(now time.Time) {
+	entries, err := os.ReadDir(resultCacheDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() {
+			continue
+		}
+		if now.Sub(info.ModTime()) > resultCacheTTL {
+			os.Remove(filepath.Join(resultCacheDir, e.Name()))
+		}
+	}
+}
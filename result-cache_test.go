@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/urfave/cli/v2"
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func setupResultCache(t *testing.T) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultCacheDir, resultCacheIdentity = t.TempDir(), identity
+	t.Cleanup(func() { resultCacheDir, resultCacheIdentity = "", nil })
+}
+
+func Test_resultCache(t *testing.T) {
+	setupResultCache(t)
+	manifests := []byte("apiVersion: v1\nkind: Secret\nmetadata:\n  name: foo\ndata:\n  password: c2VjcmV0\n")
+
+	if _, ok := readResultCache("key-a"); ok {
+		t.Fatal("cache should be empty")
+	}
+	if err := writeResultCache("key-a", manifests); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := readResultCache("key-a")
+	if !ok || !bytes.Equal(got, manifests) {
+		t.Errorf("readResultCache() = %s, %v, want %s", got, ok, manifests)
+	}
+
+	data, err := os.ReadFile(filepath.Join(resultCacheDir, "key-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("c2VjcmV0")) {
+		t.Error("cached build output should be encrypted")
+	}
+
+	// output of other key can't be used
+	if err := os.WriteFile(filepath.Join(resultCacheDir, "key-b"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readResultCache("key-b"); ok {
+		t.Error("cached output of other key should not be used")
+	}
+
+	// output encrypted with other identity can't be used
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultCacheIdentity = identity
+	if _, ok := readResultCache("key-a"); ok {
+		t.Error("cached output encrypted with other identity should not be used")
+	}
+
+	// expired output is removed
+	expired := time.Now().Add(-resultCacheTTL - time.Minute)
+	if err := os.Chtimes(filepath.Join(resultCacheDir, "key-a"), expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readResultCache("key-a"); ok {
+		t.Error("expired output should not be used")
+	}
+	if fileExists(filepath.Join(resultCacheDir, "key-a")) {
+		t.Error("expired output should be removed")
+	}
+}
+
+func Test_resultCacheKey(t *testing.T) {
+	setupResultCache(t)
+	identityFile := filepath.Join(t.TempDir(), "identity")
+	if err := os.WriteFile(identityFile, []byte(resultCacheIdentity.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// cache is configured by flags
+	t.Setenv("AVP_RESULT_CACHE_DIR", resultCacheDir)
+	t.Setenv("AVP_RESULT_CACHE_IDENTITY_FILE", identityFile)
+
+	keyring := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-strongbox-keyring", Namespace: "bar", ResourceVersion: "1"},
+		Data:       map[string][]byte{".strongbox_keyring": []byte("keyentries: []")},
+	}
+	kubeClient = fake.NewSimpleClientset(keyring)
+
+	cacheKey := func(t *testing.T, revision, path, appEnv string) string {
+		t.Helper()
+		t.Setenv("ARGOCD_APP_NAME", "foo")
+		t.Setenv("ARGOCD_APP_NAMESPACE", "bar")
+		t.Setenv("ARGOCD_APP_PARAMETERS", "")
+		t.Setenv("ARGOCD_APP_REVISION", revision)
+		t.Setenv("ARGOCD_APP_SOURCE_PATH", path)
+		t.Setenv("ARGOCD_ENV_HELM_ENABLED", appEnv)
+
+		var key string
+		app := &cli.App{
+			Commands: []*cli.Command{{
+				Name:  "test",
+				Flags: flags,
+				Action: func(c *cli.Context) (err error) {
+					app := applicationInfo{
+						name:                 c.String("app-name"),
+						destinationNamespace: c.String("app-namespace"),
+						keyringSecrets:       keyringSecrets(c),
+					}
+					key, err = resultCacheKey(c, app)
+					return err
+				},
+			}},
+		}
+		if err := app.Run([]string{"plugin", "test"}); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	key := cacheKey(t, "abc123", "apps/foo", "")
+	if key == "" {
+		t.Fatal("key should not be empty")
+	}
+	if got := cacheKey(t, "abc123", "apps/foo", ""); got != key {
+		t.Errorf("key should be same for same inputs got:%s want:%s", got, key)
+	}
+	if got := cacheKey(t, "", "apps/foo", ""); got != "" {
+		t.Errorf("key should be empty without revision got:%s", got)
+	}
+
+	for name, got := range map[string]string{
+		"revision": cacheKey(t, "def456", "apps/foo", ""),
+		"path":     cacheKey(t, "abc123", "apps/bar", ""),
+		"app-env":  cacheKey(t, "abc123", "apps/foo", "true"),
+	} {
+		if got == key {
+			t.Errorf("key should change with %s", name)
+		}
+	}
+
+	keyring.ResourceVersion = "2"
+	kubeClient = fake.NewSimpleClientset(keyring)
+	if got := cacheKey(t, "abc123", "apps/foo", ""); got == key {
+		t.Error("key should change with secret resource version")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	kErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersV1 "k8s.io/client-go/listers/core/v1"
+)
+
+// secretCacheSocket is the path of the unix socket of the secret cache server,
+// if socket doesn't exist secrets are fetched from kube API directly
+var secretCacheSocket string
+
+// secretCache serves secrets from informers watching secrets of the configured names
+// across all namespaces, listers are keyed by the secret name
+type secretCache struct {
+	listers map[string]listersV1.SecretLister
+}
+
+// newSecretCache starts filtered Secret informer for each of the given secret names
+// and waits until all of them are synced
+func newSecretCache(ctx context.Context, client kubernetes.Interface, names []string) (*secretCache, error) {
+	sc := &secretCache{listers: make(map[string]listersV1.SecretLister)}
+	for _, name := range names {
+		if name == "" || sc.listers[name] != nil {
+			continue
+		}
+		factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+			informers.WithTweakListOptions(func(o *metaV1.ListOptions) {
+				o.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+			}),
+		)
+		sc.listers[name] = factory.Core().V1().Secrets().Lister()
+		factory.Start(ctx.Done())
+		for _, synced := range factory.WaitForCacheSync(ctx.Done()) {
+			if !synced {
+				return nil, fmt.Errorf("unable to sync Secret informer: secret=%s", name)
+			}
+		}
+		logger.Info("Secret informer synced", "secret", name)
+	}
+	return sc, nil
+}
+
+// ServeHTTP returns Secret of the `/secrets/{namespace}/{name}` path as json.
+// only configured secret names are cached, for other names bad request is
+// returned so that client can fetch it from kube API directly
+func (sc *secretCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	namespace, name := r.PathValue("namespace"), r.PathValue("name")
+	lister, ok := sc.listers[name]
+	if !ok {
+		http.Error(w, "secret is not cached", http.StatusBadRequest)
+		return
+	}
+	sec, err := lister.Secrets(namespace).Get(name)
+	if kErrors.IsNotFound(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sec); err != nil {
+		logger.Error("unable to write Secret", "secretNamespace", namespace, "secretName", name, "err", err)
+	}
+}
+
+// runSecretCacheServer serves secrets of the given names from the cache over the
+// unix socket until context is cancelled. socket is only created once all
+// informers are synced, so that clients never read from partial cache
+func runSecretCacheServer(ctx context.Context, client kubernetes.Interface, socket string, names []string) error {
+	sc, err := newSecretCache(ctx, client, names)
+	if err != nil {
+		return err
+	}
+
+	// remove socket left by previous run
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove secret cache socket err:%s", err)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("unable to listen on secret cache socket err:%s", err)
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("unable to set permissions of secret cache socket err:%s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /secrets/{namespace}/{name}", sc)
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("serving secrets", "socket", socket, "secrets", slices.Sorted(maps.Keys(sc.listers)))
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("unable to serve secrets err:%s", err)
+	}
+	return nil
+}
+
+// cachedSecret returns Secret from the secret cache server. it returns false if server is not
+// running, it doesn't cache the secret or the secret is not found in the cache, in which case
+// Secret should be fetched from kube API. since informer can lag behind, Secret created just
+// before the build might not be in the cache yet.
+func cachedSecret(ctx context.Context, namespace, name string) (*v1.Secret, bool) {
+	if secretCacheSocket == "" || !fileExists(secretCacheSocket) {
+		return nil, false
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", secretCacheSocket)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://secret-cache/secrets/"+namespace+"/"+name, nil)
+	if err != nil {
+		return nil, false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Warn("unable to get Secret from cache, falling back to kube API", "secretNamespace", namespace, "secretName", name, "err", err)
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		sec := &v1.Secret{}
+		if err := json.NewDecoder(resp.Body).Decode(sec); err != nil {
+			logger.Warn("unable to decode Secret from cache, falling back to kube API", "secretNamespace", namespace, "secretName", name, "err", err)
+			return nil, false
+		}
+		return sec, true
+	case http.StatusNotFound:
+		logger.Debug("Secret not found in cache, falling back to kube API", "secretNamespace", namespace, "secretName", name)
+		return nil, false
+	default:
+		logger.Debug("Secret is not served by cache, falling back to kube API", "secretNamespace", namespace, "secretName", name, "status", resp.StatusCode)
+		return nil, false
+	}
+}
+
+// getSecret gets Secret from the secret cache server if its running otherwise from kube API
+func getSecret(ctx context.Context, namespace, name string) (*v1.Secret, error) {
+	if sec, ok := cachedSecret(ctx, namespace, name); ok {
+		return sec, nil
+	}
+	return kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metaV1.GetOptions{})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_secretCache(t *testing.T) {
+	// unix socket path is limited to 108 chars so test temp dir can't be used
+	dir, err := os.MkdirTemp("", "avp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretCacheSocket = filepath.Join(dir, "secrets.sock")
+	defer func() { secretCacheSocket = "" }()
+
+	keyring := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-strongbox-keyring", Namespace: "foo", ResourceVersion: "1"},
+		Data:       map[string][]byte{".strongbox_keyring": []byte("keyentries: []")},
+	}
+	other := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: "other", Namespace: "foo"},
+		Data:       map[string][]byte{"key": []byte("direct")},
+	}
+	// not in the cache yet, as if created just before the build
+	created := &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: "argocd-voodoobox-git-ssh", Namespace: "bar"},
+		Data:       map[string][]byte{"key": []byte("created")},
+	}
+	// secrets served by cache are not fetched from kube API
+	kubeClient = fake.NewSimpleClientset(other, created)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- runSecretCacheServer(ctx, fake.NewSimpleClientset(keyring, other), secretCacheSocket,
+			[]string{"argocd-voodoobox-strongbox-keyring", "argocd-voodoobox-git-ssh", ""})
+	}()
+	for i := 0; !fileExists(secretCacheSocket); i++ {
+		if i == 100 {
+			t.Fatal("secret cache socket should be created")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	app := applicationInfo{name: "app-foo", destinationNamespace: "foo"}
+
+	got, err := secret(context.Background(), app, secretInfo{name: "argocd-voodoobox-strongbox-keyring"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ResourceVersion != "1" || string(got.Data[".strongbox_keyring"]) != "keyentries: []" {
+		t.Errorf("unexpected cached Secret %+v", got)
+	}
+
+	// secret of cached name missing from the cache and kube API is not found
+	if _, err := secret(context.Background(), app, secretInfo{name: "argocd-voodoobox-git-ssh"}); !errors.Is(err, errNotFound) {
+		t.Errorf("secret() error = %v, want %v", err, errNotFound)
+	}
+
+	// secret of cached name missing from the cache is fetched from kube API
+	got, err = secret(context.Background(), applicationInfo{name: "app-bar", destinationNamespace: "bar"}, secretInfo{name: "argocd-voodoobox-git-ssh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Data["key"]) != "created" {
+		t.Errorf("unexpected Secret %+v", got)
+	}
+
+	// secrets of other names are fetched from kube API
+	got, err = secret(context.Background(), app, secretInfo{name: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Data["key"]) != "direct" {
+		t.Errorf("unexpected Secret %+v", got)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// falls back to kube API once socket is removed
+	os.Remove(secretCacheSocket)
+	if _, err := secret(context.Background(), app, secretInfo{name: "argocd-voodoobox-strongbox-keyring"}); !errors.Is(err, errNotFound) {
+		t.Errorf("secret() error = %v, want %v", err, errNotFound)
+	}
+}
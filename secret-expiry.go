@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	kErrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	rotationDueEventReason = "SecretRotationDue"
+	// rotationDueEventInterval is the min interval between updates of the same Event,
+	// so that builds during sync storm don't update it every time
+	rotationDueEventInterval = time.Hour
+)
+
+var (
+	// notAfterSecretAnnotation is the annotation of the keyring and git ssh secrets
+	// containing time after which secret can't be used
+	notAfterSecretAnnotation string
+	// rotateBySecretAnnotation is the annotation of the keyring and git ssh secrets
+	// containing time after which warnings are emitted until secret is rotated
+	rotateBySecretAnnotation string
+)
+
+// parseSecretTime parses time of the expiry annotations either in RFC3339 format
+// i.e. `2025-01-31T12:00:00Z` or as date i.e. `2025-01-31`. date includes the whole day
+// in UTC, so the returned time is the start of the next day
+func parseSecretTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+// checkSecretExpiry returns error if `not-after` annotation of the Secret has passed, once
+// `rotate-by` annotation has passed it only logs warning and records warning Event in the
+// app's namespace. invalid `not-after` is an error so that typo never disables the expiry.
+func checkSecretExpiry(ctx context.Context, app applicationInfo, sec *v1.Secret, now time.Time) error {
+	if v, ok := sec.Annotations[notAfterSecretAnnotation]; ok && notAfterSecretAnnotation != "" {
+		notAfter, err := parseSecretTime(v)
+		if err != nil {
+			return fmt.Errorf("unable to parse Secret expiry annotation: annotation=%s secretNamespace=%s secretName=%s err:%s", notAfterSecretAnnotation, sec.Namespace, sec.Name, err)
+		}
+		if !now.Before(notAfter) {
+			logger.Error("Secret has expired", "secretNamespace", sec.Namespace, "secretName", sec.Name, "notAfter", v)
+			return fmt.Errorf("unable to use expired Secret: annotation=%s notAfter=%s secretNamespace=%s secretName=%s", notAfterSecretAnnotation, v, sec.Namespace, sec.Name)
+		}
+	}
+
+	if v, ok := sec.Annotations[rotateBySecretAnnotation]; ok && rotateBySecretAnnotation != "" {
+		rotateBy, err := parseSecretTime(v)
+		if err != nil {
+			logger.Warn("unable to parse Secret rotation annotation", "annotation", rotateBySecretAnnotation, "secretNamespace", sec.Namespace, "secretName", sec.Name, "err", err)
+			return nil
+		}
+		if !now.Before(rotateBy) {
+			logger.Warn("Secret rotation is due", "secretNamespace", sec.Namespace, "secretName", sec.Name, "rotateBy", v)
+			if err := recordRotationDueEvent(ctx, app, sec, v, now); err != nil {
+				logger.Warn("unable to record Secret rotation Event", "secretNamespace", sec.Namespace, "secretName", sec.Name, "err", err)
+			}
+		}
+	}
+	return nil
+}
+
+// recordRotationDueEvent records warning Event in the app's namespace referring to the Secret.
+// Event has event time and reporting controller set, since only such Events can refer to
+// objects of other namespaces (shared secrets). like kube event recorder, same Event is
+// updated with the count and last timestamp so that repeated builds don't create new Events,
+// but at most once per rotationDueEventInterval. Events are not recorded for local secrets.
+func recordRotationDueEvent(ctx context.Context, app applicationInfo, sec *v1.Secret, rotateBy string, now time.Time) error {
+	if kubeClient == nil || localSecrets[sec.Name] == sec {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s.%s.rotation-due", sec.Namespace, sec.Name)
+	message := fmt.Sprintf("Secret rotation is due: annotation=%s rotateBy=%s secretNamespace=%s secretName=%s app=%s",
+		rotateBySecretAnnotation, rotateBy, sec.Namespace, sec.Name, app.name)
+
+	events := kubeClient.CoreV1().Events(app.destinationNamespace)
+	event, err := events.Get(ctx, name, metaV1.GetOptions{})
+	if err == nil {
+		if now.Sub(event.LastTimestamp.Time) < rotationDueEventInterval {
+			return nil
+		}
+		event.Count++
+		event.LastTimestamp = metaV1.NewTime(now)
+		event.Message = message
+		_, err = events.Update(ctx, event, metaV1.UpdateOptions{})
+		return err
+	}
+	if !kErrors.IsNotFound(err) {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "argocd-voodoobox-plugin"
+	}
+	_, err = events.Create(ctx, &v1.Event{
+		ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: app.destinationNamespace},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion: "v1", Kind: "Secret", Namespace: sec.Namespace, Name: sec.Name, UID: sec.UID, ResourceVersion: sec.ResourceVersion,
+		},
+		Reason:              rotationDueEventReason,
+		Message:             message,
+		Type:                v1.EventTypeWarning,
+		Action:              "Build",
+		Source:              v1.EventSource{Component: "argocd-voodoobox-plugin", Host: hostname},
+		ReportingController: "argocd-voodoobox-plugin",
+		ReportingInstance:   hostname,
+		EventTime:           metaV1.NewMicroTime(now),
+		FirstTimestamp:      metaV1.NewTime(now),
+		LastTimestamp:       metaV1.NewTime(now),
+		Count:               1,
+	}, metaV1.CreateOptions{})
+	return err
+}
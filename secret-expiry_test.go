@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func setupSecretExpiryAnnotations(t *testing.T) {
+	t.Helper()
+	notAfterSecretAnnotation = "argocd.voodoobox.plugin.io/not-after"
+	rotateBySecretAnnotation = "argocd.voodoobox.plugin.io/rotate-by"
+	t.Cleanup(func() { notAfterSecretAnnotation, rotateBySecretAnnotation = "", "" })
+}
+
+func Test_checkSecretExpiry(t *testing.T) {
+	setupSecretExpiryAnnotations(t)
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	app := applicationInfo{name: "app-foo", destinationNamespace: "foo"}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantErrMsg  string
+	}{
+		{"no-annotations", nil, ""},
+		{"not-after-future", map[string]string{"argocd.voodoobox.plugin.io/not-after": "2025-06-02"}, ""},
+		// date includes the whole day
+		{"not-after-today", map[string]string{"argocd.voodoobox.plugin.io/not-after": "2025-06-01"}, ""},
+		{"not-after-yesterday", map[string]string{"argocd.voodoobox.plugin.io/not-after": "2025-05-31"},
+			"unable to use expired Secret: annotation=argocd.voodoobox.plugin.io/not-after notAfter=2025-05-31 secretNamespace=foo secretName=keyring"},
+		{"not-after-passed", map[string]string{"argocd.voodoobox.plugin.io/not-after": "2025-06-01T11:59:00Z"},
+			"unable to use expired Secret: annotation=argocd.voodoobox.plugin.io/not-after notAfter=2025-06-01T11:59:00Z secretNamespace=foo secretName=keyring"},
+		{"not-after-invalid", map[string]string{"argocd.voodoobox.plugin.io/not-after": "01/06/2025"},
+			`unable to parse Secret expiry annotation: annotation=argocd.voodoobox.plugin.io/not-after secretNamespace=foo secretName=keyring err:parsing time "01/06/2025" as "2006-01-02": cannot parse "01/06/2025" as "2006"`},
+		{"rotate-by-passed", map[string]string{"argocd.voodoobox.plugin.io/rotate-by": "2025-05-01", "argocd.voodoobox.plugin.io/not-after": "2025-07-01"}, ""},
+		{"rotate-by-invalid", map[string]string{"argocd.voodoobox.plugin.io/rotate-by": "soon"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kubeClient = fake.NewSimpleClientset()
+			sec := &v1.Secret{ObjectMeta: metaV1.ObjectMeta{Name: "keyring", Namespace: "foo", Annotations: tt.annotations}}
+			err := checkSecretExpiry(context.Background(), app, sec, now)
+			if tt.wantErrMsg != "" {
+				if err == nil || err.Error() != tt.wantErrMsg {
+					t.Errorf("checkSecretExpiry() error = %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("checkSecretExpiry() unexpected error = %v", err)
+			}
+		})
+	}
+}
+
+func Test_recordRotationDueEvent(t *testing.T) {
+	setupSecretExpiryAnnotations(t)
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	kubeClient = fake.NewSimpleClientset()
+	app := applicationInfo{name: "app-foo", destinationNamespace: "foo"}
+
+	sec := &v1.Secret{ObjectMeta: metaV1.ObjectMeta{Name: "keyring", Namespace: "foo", UID: "1234", Annotations: map[string]string{
+		"argocd.voodoobox.plugin.io/rotate-by": "2025-05-01",
+	}}}
+	// Event is updated at most once per interval
+	for _, d := range []time.Duration{0, 30 * time.Minute, 2 * time.Hour} {
+		if err := checkSecretExpiry(context.Background(), app, sec, now.Add(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	event, err := kubeClient.CoreV1().Events("foo").Get(context.Background(), "foo.keyring.rotation-due", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Count != 2 || event.Type != v1.EventTypeWarning || event.Reason != rotationDueEventReason ||
+		!event.FirstTimestamp.Time.Equal(now) || !event.LastTimestamp.Time.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("unexpected Event %+v", event)
+	}
+	if event.InvolvedObject.Kind != "Secret" || event.InvolvedObject.Name != "keyring" || event.InvolvedObject.UID != "1234" {
+		t.Errorf("Event should refer to the Secret got:%+v", event.InvolvedObject)
+	}
+
+	// Event of shared secret is recorded in app's namespace and refers to the Secret
+	shared := &v1.Secret{ObjectMeta: metaV1.ObjectMeta{Name: "keyring", Namespace: "shared", Annotations: map[string]string{
+		"argocd.voodoobox.plugin.io/rotate-by": "2025-05-01T00:00:00Z",
+	}}}
+	if err := checkSecretExpiry(context.Background(), app, shared, now); err != nil {
+		t.Fatal(err)
+	}
+	event, err = kubeClient.CoreV1().Events("foo").Get(context.Background(), "shared.keyring.rotation-due", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.InvolvedObject.Kind != "Secret" || event.InvolvedObject.Name != "keyring" || event.InvolvedObject.Namespace != "shared" ||
+		event.EventTime.IsZero() || event.ReportingController == "" || event.ReportingInstance == "" || event.Action == "" {
+		t.Errorf("Event should refer to the shared Secret got:%+v", event)
+	}
+}
+
+func Test_secretExpiry(t *testing.T) {
+	setupSecretExpiryAnnotations(t)
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Secret{
+			ObjectMeta: metaV1.ObjectMeta{Name: "expired", Namespace: "foo", Annotations: map[string]string{
+				"argocd.voodoobox.plugin.io/not-after": "2020-01-01",
+			}},
+		},
+	)
+	app := applicationInfo{name: "app-foo", destinationNamespace: "foo"}
+
+	if _, err := secret(context.Background(), app, secretInfo{name: "expired", checkExpiry: true}); err == nil {
+		t.Error("expired Secret should not be used")
+	}
+	// expiry is only checked for keyring and git ssh secrets
+	if _, err := secret(context.Background(), app, secretInfo{name: "expired"}); err != nil {
+		t.Errorf("secret() unexpected error = %v", err)
+	}
+
+	// expiry is also checked for local secrets
+	local := localSecret("local-expired", nil)
+	local.Annotations = map[string]string{"argocd.voodoobox.plugin.io/not-after": "2020-01-01"}
+	localSecrets = map[string]*v1.Secret{"local-expired": local}
+	defer func() { localSecrets = nil }()
+	if _, err := secret(context.Background(), app, secretInfo{name: "local-expired", checkExpiry: true}); err == nil {
+		t.Error("expired local Secret should not be used")
+	}
+}
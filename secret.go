@@ -5,47 +5,190 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"filippo.io/age/armor"
 	v1 "k8s.io/api/core/v1"
 	kErrors "k8s.io/apimachinery/pkg/api/errors"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
-var errNotFound = errors.New("not found")
+var (
+	errNotFound = errors.New("not found")
+
+	// localSecrets holds secrets read from local files keyed by secret name.
+	// if secret is found here it will not be fetched from kube API
+	localSecrets map[string]*v1.Secret
+)
 
 // secret reads Kube Secret from either working NS or specified NS
-// if different NS is used then it will verify that working NS is allowed to use that Secret
-func secret(ctx context.Context, workingNamespace string, secret secretInfo) (*v1.Secret, error) {
+// if different NS is used then it will verify that app is allowed to use that Secret
+func secret(ctx context.Context, app applicationInfo, secret secretInfo) (*v1.Secret, error) {
 
 	// if Secret Namespace is not set, then default to App's working Namespace
 	if secret.namespace == "" {
-		secret.namespace = workingNamespace
+		secret.namespace = app.destinationNamespace
+	}
+
+	if sec, ok := localSecrets[secret.name]; ok {
+		return checkedSecret(ctx, app, secret, sec)
+	}
+	if kubeClient == nil {
+		return nil, fmt.Errorf("unable to get Secret, kube client is not configured: secret=%s namespace=%s err=%w", secret.name, secret.namespace, errNotFound)
 	}
 
-	sec, err := kubeClient.CoreV1().Secrets(secret.namespace).Get(ctx, secret.name, metaV1.GetOptions{})
+	sec, err := getSecret(ctx, secret.namespace, secret.name)
 	if err != nil {
 		if kErrors.IsNotFound(err) {
-			return nil, fmt.Errorf("unable to get Secret: secret=%s namespace=%s err=%w", secret.namespace, secret.name, errNotFound)
+			return nil, fmt.Errorf("unable to get Secret: secret=%s namespace=%s err=%w", secret.name, secret.namespace, errNotFound)
 		}
-		return nil, fmt.Errorf("unable to get Secret: secret=%s namespace=%s err=%w", secret.namespace, secret.name, err)
+		return nil, fmt.Errorf("unable to get Secret: secret=%s namespace=%s err=%w", secret.name, secret.namespace, err)
 	}
 
 	// check if working Application is allowed to use Secret form another Namespace
-	if secret.namespace != workingNamespace {
-		for _, v := range strings.Split(sec.Annotations[allowedNamespacesSecretAnnotation], ",") {
-			if strings.TrimSpace(v) == workingNamespace {
-				return verifySecretEncrypted(sec)
-			}
+	if secret.namespace != app.destinationNamespace {
+		allowed, reason := sharedSecretAllowed(ctx, sec, app)
+		if !allowed {
+			logger.Warn("not allowed to use shared Secret", "secretNamespace", secret.namespace, "secretName", secret.name, "reason", reason)
+			return nil, fmt.Errorf(`not allowed to use Secret, %s: secretNamespace=%s secretName=%s`, reason, secret.namespace, secret.name)
 		}
-		return nil, fmt.Errorf(`not allowed to use Secret, working Namespace missing from annotation: annotation=%s secretNamespace=%s secretName=%s workingNamespace=%s`,
-			allowedNamespacesSecretAnnotation, secret.namespace, secret.name, workingNamespace)
+		logger.Info("allowed to use shared Secret", "secretNamespace", secret.namespace, "secretName", secret.name, "reason", reason)
 	}
 
+	return checkedSecret(ctx, app, secret, sec)
+}
+
+// checkedSecret verifies expiry of the Secret if enabled and that it doesn't contain encrypted data,
+// it is used for both local and kube secrets
+func checkedSecret(ctx context.Context, app applicationInfo, secret secretInfo, sec *v1.Secret) (*v1.Secret, error) {
+	if secret.checkExpiry {
+		if err := checkSecretExpiry(ctx, app, sec, time.Now()); err != nil {
+			return nil, err
+		}
+	}
 	return verifySecretEncrypted(sec)
 }
 
+// sharedSecretAllowed returns true if app is allowed to use Secret from another Namespace along
+// with the reason of the decision. Secret can list allowed namespaces and argocd projects or
+// app names in the annotations, if both namespaces and projects/apps are listed then app must
+// match both.
+func sharedSecretAllowed(ctx context.Context, sec *v1.Secret, app applicationInfo) (bool, string) {
+	namespaces, hasNamespaces := annotationList(sec, allowedNamespacesSecretAnnotation)
+	selector, hasSelector := "", false
+	if allowedNamespacesPatterns && allowedNamespacesSelectorSecretAnnotation != "" {
+		selector, hasSelector = sec.Annotations[allowedNamespacesSelectorSecretAnnotation]
+	}
+	projects, hasProjects := annotationList(sec, allowedProjectsSecretAnnotation)
+	apps, hasApps := annotationList(sec, allowedAppsSecretAnnotation)
+
+	if !hasNamespaces && !hasSelector && !hasProjects && !hasApps {
+		return false, fmt.Sprintf("Secret doesn't have any of the annotations: annotations=%s,%s,%s",
+			allowedNamespacesSecretAnnotation, allowedProjectsSecretAnnotation, allowedAppsSecretAnnotation)
+	}
+
+	var reasons []string
+	if hasNamespaces || hasSelector {
+		allowed, reason := namespaceAllowed(ctx, app.destinationNamespace, namespaces, selector, hasSelector)
+		if !allowed {
+			return false, reason
+		}
+		reasons = append(reasons, reason)
+	}
+
+	if hasProjects || hasApps {
+		switch {
+		case app.project != "" && slices.Contains(projects, app.project):
+			reasons = append(reasons, fmt.Sprintf("project is allowed by annotation: annotation=%s project=%s", allowedProjectsSecretAnnotation, app.project))
+		case slices.Contains(apps, app.name):
+			reasons = append(reasons, fmt.Sprintf("app is allowed by annotation: annotation=%s app=%s", allowedAppsSecretAnnotation, app.name))
+		default:
+			return false, fmt.Sprintf("project and app missing from annotations: annotations=%s,%s project=%s app=%s",
+				allowedProjectsSecretAnnotation, allowedAppsSecretAnnotation, app.project, app.name)
+		}
+	}
+	return true, strings.Join(reasons, ", ")
+}
+
+// namespaceAllowed returns true if working namespace is allowed by the entries of allowed namespaces
+// annotation or the label selector along with the reason of the decision. entries are exact names
+// unless patterns are enabled by the server in which case entries can also be globs i.e. `team-*`.
+// entries starting with `!` i.e. `!team-sandbox` or `!*-dev` deny namespaces and take precedence.
+func namespaceAllowed(ctx context.Context, namespace string, entries []string, selector string, hasSelector bool) (bool, string) {
+	// empty selector matches all namespaces, so its denied even if namespace is allowed by entries
+	var s labels.Selector
+	if hasSelector {
+		var err error
+		if s, err = labels.Parse(selector); err != nil {
+			return false, fmt.Sprintf("invalid namespace selector: annotation=%s selector=%s err:%s", allowedNamespacesSelectorSecretAnnotation, selector, err)
+		}
+		if s.Empty() {
+			return false, fmt.Sprintf("empty namespace selector is not allowed: annotation=%s workingNamespace=%s", allowedNamespacesSelectorSecretAnnotation, namespace)
+		}
+	}
+
+	for _, e := range entries {
+		if pattern, ok := strings.CutPrefix(e, "!"); ok && namespaceMatches(pattern, namespace, true) {
+			return false, fmt.Sprintf("working Namespace is denied by annotation: annotation=%s entry=%s workingNamespace=%s", allowedNamespacesSecretAnnotation, e, namespace)
+		}
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e, "!") && namespaceMatches(e, namespace, allowedNamespacesPatterns) {
+			return true, fmt.Sprintf("working Namespace is allowed by annotation: annotation=%s entry=%s workingNamespace=%s", allowedNamespacesSecretAnnotation, e, namespace)
+		}
+	}
+
+	if hasSelector {
+		ns, err := kubeClient.CoreV1().Namespaces().Get(ctx, namespace, metaV1.GetOptions{})
+		if err != nil {
+			return false, fmt.Sprintf("unable to get Namespace to match selector: annotation=%s workingNamespace=%s err:%s", allowedNamespacesSelectorSecretAnnotation, namespace, err)
+		}
+		if s.Matches(labels.Set(ns.Labels)) {
+			return true, fmt.Sprintf("working Namespace is allowed by selector: annotation=%s selector=%s workingNamespace=%s", allowedNamespacesSelectorSecretAnnotation, selector, namespace)
+		}
+	}
+
+	return false, fmt.Sprintf("working Namespace missing from annotation: annotation=%s workingNamespace=%s", allowedNamespacesSecretAnnotation, namespace)
+}
+
+// namespaceMatches returns true if namespace is same as the entry or matches the glob if enabled
+func namespaceMatches(entry, namespace string, glob bool) bool {
+	if entry == namespace {
+		return true
+	}
+	if !glob {
+		return false
+	}
+	ok, err := path.Match(entry, namespace)
+	return err == nil && ok
+}
+
+// annotationList returns comma-separated values of the annotation and
+// true if Secret has the annotation
+func annotationList(sec *v1.Secret, annotation string) ([]string, bool) {
+	if annotation == "" {
+		return nil, false
+	}
+	v, ok := sec.Annotations[annotation]
+	if !ok {
+		return nil, false
+	}
+	var values []string
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			values = append(values, e)
+		}
+	}
+	return values, true
+}
+
 // verifySecretEncrypted will go through all keys of the secret passed
 // and error out if at least one of them is encrypted
 func verifySecretEncrypted(sec *v1.Secret) (*v1.Secret, error) {
@@ -57,3 +200,34 @@ func verifySecretEncrypted(sec *v1.Secret) (*v1.Secret, error) {
 
 	return sec, nil
 }
+
+// localSecret returns Secret object with given data, it is used to
+// represent secrets read from local files
+func localSecret(name string, data map[string][]byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: "local"},
+		Data:       data,
+	}
+}
+
+// readLocalSecretDir reads all files in given dir as secret data where file name is the key.
+// hidden entries starting with `..` are skipped as those are created by kubelet for mounted secrets
+func readLocalSecretDir(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string][]byte)
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), "..") {
+			continue
+		}
+		v, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		data[e.Name()] = v
+	}
+	return data, nil
+}
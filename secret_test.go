@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	v1 "k8s.io/api/core/v1"
 	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
@@ -114,7 +119,7 @@ key: xxxxxxxxx`),
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := secret(context.Background(), tt.args.destNamespace, tt.args.secret)
+			got, err := secret(context.Background(), applicationInfo{destinationNamespace: tt.args.destNamespace}, tt.args.secret)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("getSecret() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -125,3 +130,180 @@ key: xxxxxxxxx`),
 		})
 	}
 }
+
+func Test_sharedSecretAllowed(t *testing.T) {
+	defer func(projects, apps string) {
+		allowedProjectsSecretAnnotation, allowedAppsSecretAnnotation = projects, apps
+	}(allowedProjectsSecretAnnotation, allowedAppsSecretAnnotation)
+	allowedNamespacesSecretAnnotation = "argocd.voodoobox.plugin.io/allowed-namespaces"
+	allowedProjectsSecretAnnotation = "argocd.voodoobox.plugin.io/allowed-projects"
+	allowedAppsSecretAnnotation = "argocd.voodoobox.plugin.io/allowed-apps"
+
+	app := applicationInfo{name: "argocd_app-foo", project: "team-a", destinationNamespace: "bar"}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        bool
+		wantReason  string
+	}{
+		{"no-annotations", nil, false, "Secret doesn't have any of the annotations: annotations=argocd.voodoobox.plugin.io/allowed-namespaces,argocd.voodoobox.plugin.io/allowed-projects,argocd.voodoobox.plugin.io/allowed-apps"},
+		{"namespace-allowed", map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces": "foo, bar",
+		}, true, "working Namespace is allowed by annotation: annotation=argocd.voodoobox.plugin.io/allowed-namespaces entry=bar workingNamespace=bar"},
+		{"namespace-not-allowed", map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces": "foo",
+			"argocd.voodoobox.plugin.io/allowed-projects":   "team-a",
+		}, false, "working Namespace missing from annotation: annotation=argocd.voodoobox.plugin.io/allowed-namespaces workingNamespace=bar"},
+		{"project-allowed", map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-projects": "team-b,team-a",
+		}, true, "project is allowed by annotation: annotation=argocd.voodoobox.plugin.io/allowed-projects project=team-a"},
+		{"app-allowed", map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-projects": "team-b",
+			"argocd.voodoobox.plugin.io/allowed-apps":     "argocd_app-foo",
+		}, true, "app is allowed by annotation: annotation=argocd.voodoobox.plugin.io/allowed-apps app=argocd_app-foo"},
+		{"namespace-and-project-allowed", map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces": "bar",
+			"argocd.voodoobox.plugin.io/allowed-projects":   "team-a",
+		}, true, "working Namespace is allowed by annotation: annotation=argocd.voodoobox.plugin.io/allowed-namespaces entry=bar workingNamespace=bar, project is allowed by annotation: annotation=argocd.voodoobox.plugin.io/allowed-projects project=team-a"},
+		{"namespace-allowed-project-not-allowed", map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces": "bar",
+			"argocd.voodoobox.plugin.io/allowed-projects":   "team-b",
+			"argocd.voodoobox.plugin.io/allowed-apps":       "app-foo",
+		}, false, "project and app missing from annotations: annotations=argocd.voodoobox.plugin.io/allowed-projects,argocd.voodoobox.plugin.io/allowed-apps project=team-a app=argocd_app-foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sec := &v1.Secret{ObjectMeta: metaV1.ObjectMeta{Name: "shared", Namespace: "foo", Annotations: tt.annotations}}
+			got, reason := sharedSecretAllowed(context.Background(), sec, app)
+			if got != tt.want || reason != tt.wantReason {
+				t.Errorf("sharedSecretAllowed() = %v, %s, want %v, %s", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+
+	// app without project can only be allowed by name
+	sec := &v1.Secret{ObjectMeta: metaV1.ObjectMeta{Name: "shared", Namespace: "foo", Annotations: map[string]string{
+		"argocd.voodoobox.plugin.io/allowed-projects": "",
+	}}}
+	if got, _ := sharedSecretAllowed(context.Background(), sec, applicationInfo{name: "foo", destinationNamespace: "bar"}); got {
+		t.Error("app without project should not be allowed by empty projects annotation")
+	}
+}
+
+func Test_namespaceAllowed(t *testing.T) {
+	allowedNamespacesSecretAnnotation = "argocd.voodoobox.plugin.io/allowed-namespaces"
+	defer func(patterns bool, selector, projects, apps string) {
+		allowedNamespacesPatterns, allowedNamespacesSelectorSecretAnnotation = patterns, selector
+		allowedProjectsSecretAnnotation, allowedAppsSecretAnnotation = projects, apps
+	}(allowedNamespacesPatterns, allowedNamespacesSelectorSecretAnnotation, allowedProjectsSecretAnnotation, allowedAppsSecretAnnotation)
+	allowedNamespacesSelectorSecretAnnotation = "argocd.voodoobox.plugin.io/allowed-namespaces-selector"
+	allowedProjectsSecretAnnotation, allowedAppsSecretAnnotation = "", ""
+
+	kubeClient = fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "payments-api", Labels: map[string]string{"team": "payments"}}},
+		&v1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "payments-sandbox", Labels: map[string]string{"team": "payments"}}},
+		&v1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "orders-dev", Labels: map[string]string{"team": "orders"}}},
+	)
+
+	tests := []struct {
+		name        string
+		patterns    bool
+		annotations map[string]string
+		namespace   string
+		want        bool
+		wantReason  string
+	}{
+		{"glob-disabled", false, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces": "payments-*",
+		}, "payments-api", false, "working Namespace missing from annotation: annotation=argocd.voodoobox.plugin.io/allowed-namespaces workingNamespace=payments-api"},
+		{"glob", true, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces": "orders, payments-*",
+		}, "payments-api", true, "working Namespace is allowed by annotation: annotation=argocd.voodoobox.plugin.io/allowed-namespaces entry=payments-* workingNamespace=payments-api"},
+		{"deny-overrides-glob", true, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces": "payments-*,!payments-sandbox",
+		}, "payments-sandbox", false, "working Namespace is denied by annotation: annotation=argocd.voodoobox.plugin.io/allowed-namespaces entry=!payments-sandbox workingNamespace=payments-sandbox"},
+		{"deny-glob-without-patterns", false, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces": "orders-dev,!*-dev",
+		}, "orders-dev", false, "working Namespace is denied by annotation: annotation=argocd.voodoobox.plugin.io/allowed-namespaces entry=!*-dev workingNamespace=orders-dev"},
+		{"selector", true, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces-selector": "team=payments",
+		}, "payments-api", true, "working Namespace is allowed by selector: annotation=argocd.voodoobox.plugin.io/allowed-namespaces-selector selector=team=payments workingNamespace=payments-api"},
+		{"selector-disabled", false, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces-selector": "team=payments",
+		}, "payments-api", false, "Secret doesn't have any of the annotations: annotations=argocd.voodoobox.plugin.io/allowed-namespaces,,"},
+		{"deny-overrides-selector", true, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces":          "!payments-sandbox",
+			"argocd.voodoobox.plugin.io/allowed-namespaces-selector": "team in (payments, orders)",
+		}, "payments-sandbox", false, "working Namespace is denied by annotation: annotation=argocd.voodoobox.plugin.io/allowed-namespaces entry=!payments-sandbox workingNamespace=payments-sandbox"},
+		{"selector-not-matching", true, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces-selector": "team=payments",
+		}, "orders-dev", false, "working Namespace missing from annotation: annotation=argocd.voodoobox.plugin.io/allowed-namespaces workingNamespace=orders-dev"},
+		{"invalid-selector", true, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces-selector": "team in payments",
+		}, "payments-api", false, "invalid namespace selector: annotation=argocd.voodoobox.plugin.io/allowed-namespaces-selector selector=team in payments err:"},
+		{"empty-selector", true, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces-selector": "",
+		}, "payments-api", false, "empty namespace selector is not allowed: annotation=argocd.voodoobox.plugin.io/allowed-namespaces-selector workingNamespace=payments-api"},
+		{"whitespace-selector-with-allowed-entry", true, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces":          "orders-dev",
+			"argocd.voodoobox.plugin.io/allowed-namespaces-selector": "  ",
+		}, "orders-dev", false, "empty namespace selector is not allowed: annotation=argocd.voodoobox.plugin.io/allowed-namespaces-selector workingNamespace=orders-dev"},
+		{"selector-namespace-not-found", true, map[string]string{
+			"argocd.voodoobox.plugin.io/allowed-namespaces-selector": "team=payments",
+		}, "missing", false, `unable to get Namespace to match selector: annotation=argocd.voodoobox.plugin.io/allowed-namespaces-selector workingNamespace=missing err:namespaces "missing" not found`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowedNamespacesPatterns = tt.patterns
+			sec := &v1.Secret{ObjectMeta: metaV1.ObjectMeta{Name: "shared", Namespace: "foo", Annotations: tt.annotations}}
+			got, reason := sharedSecretAllowed(context.Background(), sec, applicationInfo{name: "app", destinationNamespace: tt.namespace})
+			if got != tt.want || !strings.HasPrefix(reason, tt.wantReason) {
+				t.Errorf("sharedSecretAllowed() = %v, %s, want %v, %s", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func Test_localSecret(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "keyA"), []byte("private-key-data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "known_hosts"), []byte("known-host-data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// kubelet creates hidden data dir for mounted secrets
+	if err := os.Mkdir(filepath.Join(dir, "..data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := readLocalSecretDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"keyA":        []byte("private-key-data"),
+		"known_hosts": []byte("known-host-data"),
+	}
+	if diff := cmp.Diff(want, data); diff != "" {
+		t.Errorf("readLocalSecretDir() mismatch (-want +got):\n%s", diff)
+	}
+
+	kubeClient = nil
+	localSecrets = map[string]*v1.Secret{"argocd-voodoobox-git-ssh": localSecret("argocd-voodoobox-git-ssh", data)}
+	defer func() { localSecrets = nil }()
+
+	got, err := secret(context.Background(), applicationInfo{destinationNamespace: "foo"}, secretInfo{name: "argocd-voodoobox-git-ssh", namespace: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got.Data); diff != "" {
+		t.Errorf("secret() mismatch (-want +got):\n%s", diff)
+	}
+
+	// secrets not available locally should be reported as not found without kube client
+	_, err = secret(context.Background(), applicationInfo{destinationNamespace: "foo"}, secretInfo{name: "argocd-voodoobox-strongbox-keyring"})
+	if !errors.Is(err, errNotFound) {
+		t.Errorf("secret() error = %v, want %v", err, errNotFound)
+	}
+}